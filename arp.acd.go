@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	RFC 5227 IPv4 地址冲突检测 (Address Conflict Detection)
+	1. 使用地址之前, 先发送 PROBE_NUM 个 ARP probe (sender ip 为 0.0.0.0, target ip 为待用地址)
+	   期间如果有人声明了该地址, 或者也在探测该地址, 就说明冲突了
+	2. 探测通过后, 发送 ANNOUNCE_NUM 个免费 ARP (sender ip 和 target ip 都是自己), 宣告占用该地址
+	3. 之后若收到 sender ip 为自己地址但 mac 不同的 ARP, 在 DEFEND_INTERVAL 内防御一次, 再次冲突则放弃该地址
+*/
+const (
+	acdProbeWait        = 1 * time.Second
+	acdProbeNum         = 3
+	acdProbeMin         = 1 * time.Second
+	acdProbeMax         = 2 * time.Second
+	acdAnnounceWait     = 2 * time.Second
+	acdAnnounceNum      = 2
+	acdAnnounceInterval = 2 * time.Second
+	acdDefendInterval   = 10 * time.Second
+)
+
+type acdState uint8
+
+const (
+	acdProbing    acdState = iota // 探测中, 地址还不能使用
+	acdAnnouncing                 // 宣告中
+	acdBound                      // 地址可用
+	acdDefended                   // 检测到冲突, 已经防御
+	acdAbandoned                  // 冲突无法防御, 放弃该地址
+)
+
+func (s acdState) String() string {
+	switch s {
+	case acdProbing:
+		return "probing"
+	case acdAnnouncing:
+		return "announcing"
+	case acdBound:
+		return "bound"
+	case acdDefended:
+		return "defended"
+	case acdAbandoned:
+		return "abandoned"
+	}
+	return "unknown"
+}
+
+var errAddressConflict = errors.New("ipv4 address conflict")
+
+type acd struct {
+	dev         *device
+	addr        [4]byte
+	state       acdState
+	lastDefend  time.Time
+	conflictMAC [6]byte       // 最近一次冲突的对端 mac
+	conflict    chan [6]byte  // 探测阶段检测到的冲突
+	abandoned   chan struct{} // 放弃地址时关闭
+	stopped     chan struct{} // 地址被删除时关闭, 结束探测和宣告
+	mutex       sync.Mutex
+}
+
+func newAcd(dev *device, addr [4]byte) *acd {
+	return &acd{
+		dev:       dev,
+		addr:      addr,
+		state:     acdProbing,
+		conflict:  make(chan [6]byte, 1),
+		abandoned: make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// 地址被删除时调用
+func (a *acd) stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	select {
+	case <-a.stopped:
+	default:
+		close(a.stopped)
+	}
+}
+
+func (a *acd) getState() acdState {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.state
+}
+
+func (a *acd) setStateUnlocked(state acdState) {
+	if state == acdAbandoned && a.state != acdAbandoned {
+		close(a.abandoned)
+	}
+	a.state = state
+	fmt.Printf("%s acd %s %v %s\n", red, reset, net.IP(a.addr[:]), state)
+	if state == acdDefended || state == acdAbandoned {
+		log.Printf("address %v conflicts with %v, %s",
+			net.IP(a.addr[:]), net.HardwareAddr(a.conflictMAC[:]), state)
+	}
+}
+
+// 地址在宣告开始之后才可以使用
+func (a *acd) usable() bool {
+	switch a.getState() {
+	case acdAnnouncing, acdBound, acdDefended:
+		return true
+	}
+	return false
+}
+
+// 执行探测和宣告, 探测阶段发生冲突则返回 errAddressConflict
+func (a *acd) run(sig chan struct{}) error {
+	wait := func(d time.Duration) error {
+		select {
+		case <-sig:
+			return errors.New("stopped")
+		case <-a.stopped:
+			return errors.New("address removed")
+		case <-time.After(d):
+			return nil
+		case mac := <-a.conflict:
+			a.mutex.Lock()
+			a.conflictMAC = mac
+			a.setStateUnlocked(acdAbandoned)
+			a.mutex.Unlock()
+			return errAddressConflict
+		}
+	}
+	if err := wait(randDuration(0, acdProbeWait)); err != nil {
+		return err
+	}
+	for i := 0; i < acdProbeNum; i++ {
+		a.dev.arpRequest([4]byte{}, a.addr)
+		next := randDuration(acdProbeMin, acdProbeMax)
+		if i == acdProbeNum-1 {
+			next = acdAnnounceWait
+		}
+		if err := wait(next); err != nil {
+			return err
+		}
+	}
+	a.mutex.Lock()
+	a.setStateUnlocked(acdAnnouncing)
+	a.mutex.Unlock()
+	for i := 0; i < acdAnnounceNum; i++ {
+		a.dev.arpRequest(a.addr, a.addr)
+		if i == acdAnnounceNum-1 {
+			break
+		}
+		// 宣告阶段的冲突由 check 直接防御, 这里只需要响应退出和删除地址
+		select {
+		case <-sig:
+			return errors.New("stopped")
+		case <-a.stopped:
+			return errors.New("address removed")
+		case <-time.After(acdAnnounceInterval):
+		}
+	}
+	a.mutex.Lock()
+	if a.state == acdAnnouncing {
+		a.setStateUnlocked(acdBound)
+	}
+	a.mutex.Unlock()
+	return nil
+}
+
+// 检查收到的 ARP 是否与本地址冲突, 冲突时返回 true
+func (a *acd) check(f *arp) bool {
+	if f.SourceHardwareAddress == a.dev.hardwareAddr {
+		return false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	switch a.state {
+	case acdProbing:
+		// 别人已经在使用该地址, 或者别人也在探测该地址
+		if f.SourceProtocolAddress == a.addr ||
+			f.SourceProtocolAddress == [4]byte{} && f.TargetProtocolAddress == a.addr {
+			select {
+			case a.conflict <- f.SourceHardwareAddress:
+			default:
+			}
+			return true
+		}
+	case acdAnnouncing, acdBound, acdDefended:
+		if f.SourceProtocolAddress != a.addr {
+			return false
+		}
+		a.conflictMAC = f.SourceHardwareAddress
+		if now := time.Now(); now.Sub(a.lastDefend) > acdDefendInterval {
+			a.lastDefend = now
+			a.dev.arpRequest(a.addr, a.addr)
+			a.setStateUnlocked(acdDefended)
+		} else {
+			a.setStateUnlocked(acdAbandoned)
+		}
+		return true
+	case acdAbandoned:
+		return f.SourceProtocolAddress == a.addr
+	}
+	return false
+}
+
+func randDuration(min, max time.Duration) time.Duration {
+	return min + time.Duration(rand.Int63n(int64(max-min)+1))
+}
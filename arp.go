@@ -58,23 +58,59 @@ func (f arp) handle (dev *device, upper *eth) error{
 	if f.ProtocolType != ethernetTypeIPv4 {
 		return errors.New("UnsupportedProtocol")
 	}
-	merge := arpCache.update(f.SourceProtocolAddress, f.SourceHardwareAddress)
-	if dev.ipv4Addr != f.TargetProtocolAddress {
+	if f.SourceHardwareAddress[0]&1 != 0 || f.SourceHardwareAddress != upper.header.Src {
+		// 组播/广播 mac 不可能是 sender, 和以太网源地址不一致的多半是伪造的
+		return errors.New("ARP sender hardware address mismatch")
+	}
+	if dev.checkConflict(&f) {
+		return errAddressConflict
+	}
+	/*
+		ARP probe 不携带发送方地址, 不应该学习, 但探测的是本机正在使用的地址时要照常回复,
+		对方收到回复才知道地址已被占用 (RFC 5227 2.1.1)
+	*/
+	probe := f.SourceProtocolAddress == [4]byte{}
+	if probe && !dev.ownsIPv4(f.TargetProtocolAddress) {
+		return errors.New("ARP probe")
+	}
+	neighbors := dev.vrf() // ARP 缓存按 VRF 隔离
+	merge := !probe && neighbors.arp.update(f.SourceProtocolAddress, f.SourceHardwareAddress)
+	if !dev.ownsIPv4(f.TargetProtocolAddress) &&
+		!neighbors.proxyArp.match(dev, f.TargetProtocolAddress, f.SourceProtocolAddress) {
 		return errors.New("ARP was not for us")
 	}
-	if !merge && !arpCache.insert(f.SourceProtocolAddress, f.SourceHardwareAddress) {
-		return errors.New("No free space in ARP translation table")
+	if !probe {
+		if !merge && !neighbors.arp.insert(f.SourceProtocolAddress, f.SourceHardwareAddress) {
+			return errors.New("No free space in ARP translation table")
+		}
+		neighbors.pending.resolved(f.SourceProtocolAddress) // 发送等待该地址的数据报
 	}
 	switch f.OperationCode {
 	case ARPRequest:
-		// reply
-		f.TargetProtocolAddress = f.SourceProtocolAddress
+		// reply, 代答时 sender ip 是被请求的地址, mac 仍是设备自己的
+		f.TargetProtocolAddress, f.SourceProtocolAddress = f.SourceProtocolAddress, f.TargetProtocolAddress
 		f.TargetHardwareAddress = f.SourceHardwareAddress
 		f.SourceHardwareAddress = dev.hardwareAddr
-		f.SourceProtocolAddress = dev.ipv4Addr
 		f.OperationCode = ARPReply
 		upper.payload = f.encode()
 		upper.header.Dst = f.TargetHardwareAddress
+	default:
+		return errors.New("do nothing")
 	}
 	return nil
 }
+
+// 广播一个 ARP 请求, sender 为 0.0.0.0 时即为 ARP probe, sender 与 target 相同时即为免费 ARP
+func (dev *device) arpRequest(sender, target [4]byte) error {
+	f := arp{
+		HardwareType:          HardwareTypeEthernet,
+		ProtocolType:          ethernetTypeIPv4,
+		HardwareAddressLength: 6,
+		ProtocolAddressLength: 4,
+		OperationCode:         ARPRequest,
+		SourceHardwareAddress: dev.hardwareAddr,
+		SourceProtocolAddress: sender,
+		TargetProtocolAddress: target,
+	}
+	return dev.send(ethBroadcast, ethernetTypeARP, f.encode())
+}
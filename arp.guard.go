@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+/*
+	ARP 欺骗检测
+	ARP 没有任何认证, 任何人都可以发送一个伪造的 ARP 把某个 ip 指向自己的 mac
+	- 已知 ip 的 mac 在 arpFlipFlopWindow 内发生变化, 说明两个 mac 都在声明这个 ip, 记为 flip-flop
+	- 表项被锁定时, 拒绝 mac 变化, 记为 locked
+	事件会输出到日志, 并保留最近的 arpEventMax 条, 可以通过 arp events 查看
+*/
+const (
+	arpFlipFlopWindow = 15 * time.Second
+	arpEventMax       = 128
+)
+
+type arpEventKind uint8
+
+const (
+	arpEventFlipFlop arpEventKind = iota // 短时间内 mac 发生变化, 可能是欺骗
+	arpEventLocked                       // 表项被锁定, 拒绝了 mac 变化
+)
+
+func (k arpEventKind) String() string {
+	switch k {
+	case arpEventFlipFlop:
+		return "flip-flop"
+	case arpEventLocked:
+		return "locked"
+	}
+	return "unknown"
+}
+
+type arpEvent struct {
+	kind            arpEventKind
+	timestamp       time.Time
+	protocolAddress [4]byte
+	oldHardware     [6]byte // 表中原有的 mac
+	newHardware     [6]byte // 报文声明的 mac
+}
+
+// 表项是否拒绝 mac 变化, 调用时需持有 tbl.mutex
+func (tbl *arpTable) lockedUnlocked(entry *arpEntry) bool {
+	if entry.static {
+		return tbl.lockStatic
+	}
+	return tbl.lockLearned
+}
+
+// 记录一条可疑事件, 调用时需持有 tbl.mutex
+func (tbl *arpTable) reportUnlocked(kind arpEventKind, entry *arpEntry, hardwareAddress [6]byte) {
+	event := arpEvent{
+		kind:            kind,
+		timestamp:       time.Now(),
+		protocolAddress: entry.protocolAddress,
+		oldHardware:     entry.hardwareAddress,
+		newHardware:     hardwareAddress,
+	}
+	if len(tbl.events) == arpEventMax {
+		tbl.events = append(tbl.events[:0], tbl.events[1:]...)
+	}
+	tbl.events = append(tbl.events, event)
+	log.Printf("suspected arp poisoning (%s): %v is-at %v, was %v",
+		kind, net.IP(event.protocolAddress[:]),
+		net.HardwareAddr(event.newHardware[:]), net.HardwareAddr(event.oldHardware[:]))
+}
+
+func (tbl *arpTable) setLock(static, learned bool) {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	tbl.lockStatic, tbl.lockLearned = static, learned
+}
+
+func (tbl *arpTable) getLock() (static, learned bool) {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	return tbl.lockStatic, tbl.lockLearned
+}
+
+func (tbl *arpTable) recentEvents() []arpEvent {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	return append([]arpEvent(nil), tbl.events...)
+}
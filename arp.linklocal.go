@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+/*
+	RFC 3927 IPv4 链路本地地址自动配置
+	没有配置地址时, 从 169.254.1.0 ~ 169.254.254.255 中伪随机地选择一个地址,
+	用 ARP 探测 (与 RFC 5227 相同) 确认没人使用后占用它, 冲突时重新选择
+	随机数以 mac 为种子, 这样同一个设备每次启动倾向于选到同一个地址
+*/
+const (
+	llMaxConflicts      = 10               // 冲突次数超过该值后, 降低选择地址的速率
+	llRateLimitInterval = 60 * time.Second // 降速后两次尝试之间的间隔
+)
+
+var linkLocalPrefix = ipv4Prefix{addr: [4]byte{169, 254, 0, 0}, len: 16}
+
+func (dev *device) linkLocal(sig chan struct{}) {
+	seed := int64(binary.BigEndian.Uint32(dev.hardwareAddr[2:]))
+	rnd := rand.New(rand.NewSource(seed))
+	conflicts := 0
+	/*
+		候选地址失败 (冲突或者无法添加) 后, 选择下一个地址之前调用
+		失败次数达到 llMaxConflicts 后, 每次选择新地址之前等待 llRateLimitInterval (RFC 3927 2.2.1)
+		收到退出信号时返回 false
+	*/
+	backoff := func() bool {
+		conflicts++
+		if conflicts < llMaxConflicts {
+			return true
+		}
+		select {
+		case <-sig:
+			return false
+		case <-time.After(llRateLimitInterval):
+			return true
+		}
+	}
+	for {
+		addr := [4]byte{169, 254, byte(1 + rnd.Intn(254)), byte(rnd.Intn(256))}
+		entry, err := dev.addIPv4(addr, linkLocalPrefix.len)
+		if err != nil {
+			if !backoff() {
+				return
+			}
+			continue
+		}
+		fmt.Printf("%s  ll %s %s try %v\n", red, reset, dev.name, net.IP(addr[:]))
+		switch err := entry.acd.run(sig); err {
+		case nil:
+		case errAddressConflict:
+			dev.removeIPv4(addr)
+			if !backoff() {
+				return
+			}
+			continue
+		default:
+			return
+		}
+		// 地址已经占用, 直到防御失败才重新选择
+		select {
+		case <-sig:
+			return
+		case <-entry.acd.abandoned:
+			dev.removeIPv4(addr)
+			if !backoff() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+)
+
+/*
+	proxy ARP (RFC 1027)
+	对于配置在某个设备上的网段, 设备用自己的 mac 回应针对该网段内地址的 ARP 请求,
+	这样同一个二层网段内的主机不需要修改路由, 就可以把流量交给协议栈转发
+	代理的网段按 VRF 隔离, 设备移到其它 VRF 时删除它的网段
+*/
+type proxyArpEntry struct {
+	dev    *device
+	prefix ipv4Prefix
+}
+
+type proxyArpTable struct {
+	storage []proxyArpEntry
+	mutex   sync.RWMutex
+}
+
+func (tbl *proxyArpTable) add(dev *device, prefix ipv4Prefix) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for _, entry := range tbl.storage {
+		if entry.dev == dev && entry.prefix == prefix {
+			return false
+		}
+	}
+	tbl.storage = append(tbl.storage, proxyArpEntry{dev: dev, prefix: prefix})
+	return true
+}
+
+func (tbl *proxyArpTable) remove(dev *device, prefix ipv4Prefix) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for i, entry := range tbl.storage {
+		if entry.dev == dev && entry.prefix == prefix {
+			tbl.storage = append(tbl.storage[:i], tbl.storage[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (tbl *proxyArpTable) removeDevice(dev *device) {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	kept := tbl.storage[:0]
+	for _, entry := range tbl.storage {
+		if entry.dev != dev {
+			kept = append(kept, entry)
+		}
+	}
+	tbl.storage = kept
+}
+
+// 判断设备是否应该代答对 target 的 ARP 请求
+// 请求方自己也在代理的网段内时, target 很可能和它在同一个链路上, 这时不代答
+func (tbl *proxyArpTable) match(dev *device, target, sender [4]byte) bool {
+	if target == sender || sender == [4]byte{} { // 不代答免费 ARP 和 ARP probe
+		return false
+	}
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	for _, entry := range tbl.storage {
+		if entry.dev == dev && entry.prefix.contains(target) && !entry.prefix.contains(sender) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tbl *proxyArpTable) entries() []proxyArpEntry {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	return append([]proxyArpEntry(nil), tbl.storage...)
+}
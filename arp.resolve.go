@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+	下一跳的 mac 不在 ARP 缓存中时, 先把数据报挂起, 广播 ARP 请求
+	收到应答后把挂起的数据报发送出去, 重试 arpResolveRetries 次仍没有应答则丢弃, 并通知发送者
+*/
+const (
+	arpResolveRetries  = 3
+	arpResolveInterval = time.Second
+	arpPendingMax      = 64 // 每个地址最多挂起的数据报个数
+)
+
+var errHostUnreachable = errors.New("host unreachable")
+
+// 挂起的数据报发送成功或失败时调用, 参数 f 是挂起时拷贝的数据报
+type arpDoneFunc func(f *ipv4, err error)
+
+type arpPendingPacket struct {
+	f    *ipv4
+	done arpDoneFunc // 可以为 nil
+}
+
+type arpPendingEntry struct {
+	dev     *device
+	nextHop [4]byte
+	packets []arpPendingPacket
+	retries int
+	timer   *time.Timer
+}
+
+type arpResolver struct {
+	cache   *arpTable // 解析结果所在的 ARP 缓存
+	pending map[[4]byte]*arpPendingEntry
+	mutex   sync.Mutex
+}
+
+var arpPendingQueue = newArpResolver(arpCache)
+
+func newArpResolver(cache *arpTable) *arpResolver {
+	return &arpResolver{
+		cache:   cache,
+		pending: make(map[[4]byte]*arpPendingEntry),
+	}
+}
+
+// 解析下一跳的 mac 并发送数据报, 缓存命中时直接返回发送的结果, 否则挂起数据报并返回 nil
+func (dev *device) outputIPv4(f *ipv4, nextHop [4]byte, done arpDoneFunc) error {
+	v := dev.vrf()
+	if entry := v.arp.lookup(nextHop); entry != nil {
+		return dev.transmitIPv4(f, entry.hardwareAddress)
+	}
+	v.pending.enqueue(dev, nextHop, f, done)
+	return nil
+}
+
+func (r *arpResolver) enqueue(dev *device, nextHop [4]byte, f *ipv4, done arpDoneFunc) {
+	copied := *f // 收包的缓冲区会被复用, 需要拷贝
+	copied.options = append([]byte(nil), f.options...)
+	copied.payload = append([]byte(nil), f.payload...)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry := r.pending[nextHop]
+	if entry == nil {
+		entry = &arpPendingEntry{dev: dev, nextHop: nextHop}
+		r.pending[nextHop] = entry
+		entry.timer = time.AfterFunc(arpResolveInterval, func() { r.retry(entry) })
+		dev.arpRequest(dev.selectSourceIPv4(nextHop), nextHop)
+	}
+	if len(entry.packets) == arpPendingMax { // 丢弃最早的数据报
+		if first := entry.packets[0]; first.done != nil {
+			go first.done(first.f, errors.New("arp pending queue overflow"))
+		}
+		entry.packets = entry.packets[1:]
+	}
+	entry.packets = append(entry.packets, arpPendingPacket{f: &copied, done: done})
+}
+
+func (r *arpResolver) retry(entry *arpPendingEntry) {
+	r.mutex.Lock()
+	if r.pending[entry.nextHop] != entry {
+		r.mutex.Unlock()
+		return
+	}
+	entry.retries++
+	if entry.retries < arpResolveRetries {
+		entry.timer.Reset(arpResolveInterval)
+		r.mutex.Unlock()
+		entry.dev.arpRequest(entry.dev.selectSourceIPv4(entry.nextHop), entry.nextHop)
+		return
+	}
+	delete(r.pending, entry.nextHop)
+	r.mutex.Unlock()
+	for _, p := range entry.packets {
+		if p.done != nil {
+			p.done(p.f, errHostUnreachable)
+		}
+	}
+}
+
+// 学习到 addr 的 mac 之后, 发送挂起的数据报
+func (r *arpResolver) resolved(addr [4]byte) {
+	cached := r.cache.lookup(addr)
+	if cached == nil {
+		return
+	}
+	r.mutex.Lock()
+	entry := r.pending[addr]
+	if entry != nil {
+		entry.timer.Stop()
+		delete(r.pending, addr)
+	}
+	r.mutex.Unlock()
+	if entry == nil {
+		return
+	}
+	for _, p := range entry.packets {
+		err := entry.dev.transmitIPv4(p.f, cached.hardwareAddress)
+		if err != nil && p.done != nil {
+			p.done(p.f, err)
+		}
+	}
+}
@@ -5,22 +5,30 @@ import (
 	"time"
 )
 
+// 动态表项的存活时间, 超时后由 age 清除
+const arpEntryTTL = 60 * time.Second
+
 type arpEntry struct {
 	protocolAddress [4]byte
 	hardwareAddress [6]byte
 	timestamp       time.Time
+	static          bool // 静态表项: 不会老化, 默认也不会被学习到的地址覆盖
 }
 // arp 缓存表
 type arpTable struct {
-	storage []*arpEntry
-	mutex   sync.RWMutex
+	storage     []*arpEntry
+	lockStatic  bool // 静态表项拒绝学习到的 mac
+	lockLearned bool // 动态表项在老化之前拒绝 mac 变化
+	events      []arpEvent
+	mutex       sync.RWMutex
 }
 
 var arpCache *arpTable = newArpTable()
 
 func newArpTable() *arpTable {
 	return &arpTable{
-		storage: make([]*arpEntry, 0, 1024),
+		storage:    make([]*arpEntry, 0, 1024),
+		lockStatic: true,
 	}
 }
 
@@ -46,8 +54,18 @@ func (tbl *arpTable) update(protocolAddress [4]byte, hardwareAddress [6]byte) bo
 	if entry == nil {
 		return false
 	}
+	now := time.Now()
+	if entry.hardwareAddress != hardwareAddress {
+		if tbl.lockedUnlocked(entry) {
+			tbl.reportUnlocked(arpEventLocked, entry, hardwareAddress)
+			return true
+		}
+		if now.Sub(entry.timestamp) < arpFlipFlopWindow {
+			tbl.reportUnlocked(arpEventFlipFlop, entry, hardwareAddress)
+		}
+	}
 	entry.hardwareAddress = hardwareAddress
-	entry.timestamp = time.Now()
+	entry.timestamp = now
 	return true
 }
 
@@ -66,9 +84,90 @@ func (tbl *arpTable) insert(protocolAddress [4]byte, hardwareAddress [6]byte) bo
 	return true
 }
 
+// 添加静态表项, 已存在的同地址表项(无论动态还是静态)会被替换
+func (tbl *arpTable) insertStatic(protocolAddress [4]byte, hardwareAddress [6]byte) {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	entry := tbl.lookupUnlocked(protocolAddress)
+	if entry == nil {
+		entry = &arpEntry{protocolAddress: protocolAddress}
+		tbl.storage = append(tbl.storage, entry)
+	}
+	entry.hardwareAddress = hardwareAddress
+	entry.timestamp = time.Now()
+	entry.static = true
+}
+
+func (tbl *arpTable) remove(protocolAddress [4]byte) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for i, entry := range tbl.storage {
+		if entry.protocolAddress == protocolAddress {
+			tbl.storage = append(tbl.storage[:i], tbl.storage[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 删除满足条件的表项, 返回删除的个数
+func (tbl *arpTable) removeIf(cond func(entry *arpEntry) bool) int {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	kept := tbl.storage[:0]
+	for _, entry := range tbl.storage {
+		if !cond(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	n := len(tbl.storage) - len(kept)
+	for i := len(kept); i < len(tbl.storage); i++ {
+		tbl.storage[i] = nil
+	}
+	tbl.storage = kept
+	return n
+}
+
+// 清空所有动态表项, 静态表项只能通过 remove 删除
+func (tbl *arpTable) flush() int {
+	return tbl.removeIf(func(entry *arpEntry) bool {
+		return !entry.static
+	})
+}
+
+func (tbl *arpTable) expire(now time.Time) int {
+	return tbl.removeIf(func(entry *arpEntry) bool {
+		return !entry.static && now.Sub(entry.timestamp) > arpEntryTTL
+	})
+}
+
+// 定期老化动态表项, 直到 sig 被关闭
+func (tbl *arpTable) age(sig chan struct{}) {
+	ticker := time.NewTicker(arpEntryTTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sig:
+			return
+		case now := <-ticker.C:
+			tbl.expire(now)
+		}
+	}
+}
+
+// 返回表项的快照, 供展示使用
+func (tbl *arpTable) entries() []arpEntry {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	list := make([]arpEntry, 0, len(tbl.storage))
+	for _, entry := range tbl.storage {
+		list = append(list, *entry)
+	}
+	return list
+}
+
 func (tbl *arpTable) length() int {
 	tbl.mutex.RLock()
 	defer tbl.mutex.RUnlock()
 	return len(tbl.storage)
 }
-
@@ -0,0 +1,50 @@
+// +build ctl
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+/*
+	先启动协议栈 (如 sudo go run -tags arp .), 然后在另一个终端执行
+	sudo go run -tags ctl . arp -a
+	sudo go run -tags ctl . arp -s 10.1.0.2 02:00:00:00:00:02
+	sudo go run -tags ctl . arp -d 10.1.0.2
+	sudo go run -tags ctl . arp -F
+	sudo go run -tags ctl . arp proxy add dev1 10.1.8.0/24
+	sudo go run -tags ctl . addr
+	sudo go run -tags ctl . addr add dev1 10.1.0.5/24
+	sudo go run -tags ctl . addr add dev1 fd00:1::1/64
+	sudo go run -tags ctl . maddr
+	sudo go run -tags ctl . link set dev1 mtu 1400
+	sudo go run -tags ctl . neigh add dev1 fe80::2 02:00:00:00:00:02
+	sudo go run -tags ctl . route add default via 10.1.0.2
+	sudo go run -tags ctl . route add default via 10.2.0.2 table 100
+	sudo go run -tags ctl . rule add from 10.2.0.1 table 100
+	sudo go run -tags ctl . vrf add red
+	sudo go run -tags ctl . vrf set dev2 red
+	sudo go run -tags ctl . vrf exec red route
+	sudo go run -tags ctl . forward on
+	sudo go run -tags ctl . filter rp strict
+	sudo go run -tags ctl . vrf exec red filter rp loose
+	sudo go run -tags ctl . ping -c 4 10.1.0.2
+*/
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: ctl <command> [args...]")
+		os.Exit(2)
+	}
+	c, err := net.Dial("unix", ctlSocketPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer c.Close()
+	fmt.Fprintln(c, strings.Join(os.Args[1:], " "))
+	io.Copy(os.Stdout, c)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+	addr                          显示各设备的地址以及冲突检测状态
+	addr add <dev> <addr/len>     添加地址, 如 addr add dev1 10.1.0.5/24 或 addr add dev1 fd00:1::5/64
+	addr del <dev> <addr>         删除地址
+	addr genmode [eui64|stable]   显示/设置 ipv6 自动配置地址的接口标识生成方式, 只影响之后生成的地址
+*/
+func addrCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		return addrShow(), nil
+	}
+	if args[0] == "genmode" {
+		return addrGenModeCtl(args[1:])
+	}
+	if len(args) != 3 {
+		return "", errors.New("usage: addr [add|del <dev> <addr>]")
+	}
+	dev := deviceByName(args[1])
+	if dev == nil {
+		return "", fmt.Errorf("%s: no such device", args[1])
+	}
+	if strings.Contains(args[2], ":") {
+		return addr6Ctl(dev, args[0], args[2])
+	}
+	switch args[0] {
+	case "add":
+		addr, prefixLen, err := parseIPv4Address(args[2])
+		if err != nil {
+			return "", err
+		}
+		entry, err := dev.addIPv4(addr, prefixLen)
+		if err != nil {
+			return "", err
+		}
+		dev.mutex.RLock()
+		sig := dev.sig
+		dev.mutex.RUnlock()
+		if sig != nil { // 设备已经在运行, 立即开始冲突检测
+			go entry.acd.run(sig)
+		}
+		return "", nil
+	case "del":
+		addr, err := parseIPv4(args[2])
+		if err != nil {
+			return "", err
+		}
+		if !dev.removeIPv4(addr) {
+			return "", fmt.Errorf("%s: no such address", args[2])
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown command %q", args[0])
+}
+
+func addrShow() string {
+	var b strings.Builder
+	for _, dev := range devices {
+		fmt.Fprintf(&b, "%s: %v mtu %d vrf %s\n", dev.name, net.HardwareAddr(dev.hardwareAddr[:]), dev.linkMTU(), dev.vrf().name)
+		for _, a := range dev.ipv4Addresses() {
+			fmt.Fprintf(&b, "    inet %v/%d", net.IP(a.addr[:]), a.prefix.len)
+			if brd, ok := a.broadcast(); ok {
+				fmt.Fprintf(&b, " brd %v", net.IP(brd[:]))
+			}
+			fmt.Fprintf(&b, " %s\n", a.acd.getState())
+		}
+		for _, a := range dev.ipv6Addresses() {
+			scope := "global"
+			if ipv6IsLinkLocal(a.addr) {
+				scope = "link"
+			}
+			fmt.Fprintf(&b, "    inet6 %v/%d scope %s %s", net.IP(a.addr[:]), a.prefix.len, scope, a.state)
+			if a.autoconf {
+				fmt.Fprintf(&b, " autoconf valid_lft %s preferred_lft %s",
+					lifetimeString(a.validUntil), lifetimeString(a.preferredUntil))
+			}
+			fmt.Fprintln(&b)
+		}
+	}
+	return b.String()
+}
+
+// 剩余的生存期, 零值表示永久
+func lifetimeString(deadline time.Time) string {
+	if deadline.IsZero() {
+		return "forever"
+	}
+	if left := time.Until(deadline); left > 0 {
+		return left.Truncate(time.Second).String()
+	}
+	return "0s"
+}
+
+func addrGenModeCtl(args []string) (string, error) {
+	switch {
+	case len(args) == 0:
+		return ipv6AddrGenModeCurrent().String() + "\n", nil
+	case args[0] == "eui64":
+		setIPv6AddrGenMode(ipv6AddrGenEUI64)
+	case args[0] == "stable":
+		setIPv6AddrGenMode(ipv6AddrGenStable)
+	default:
+		return "", errors.New("usage: addr genmode [eui64|stable]")
+	}
+	return "", nil
+}
+
+func addr6Ctl(dev *device, cmd, arg string) (string, error) {
+	switch cmd {
+	case "add":
+		addr, prefixLen, err := parseIPv6Address(arg)
+		if err != nil {
+			return "", err
+		}
+		if _, err = dev.addIPv6(addr, prefixLen); err != nil {
+			return "", err
+		}
+		dev.mutex.RLock()
+		sig := dev.sig
+		dev.mutex.RUnlock()
+		if sig != nil { // 设备已经在运行, 立即开始 DAD
+			go dev.startDAD(addr, sig)
+		}
+		return "", nil
+	case "del":
+		addr, err := parseIPv6(arg)
+		if err != nil {
+			return "", err
+		}
+		if !dev.removeIPv6(addr) {
+			return "", fmt.Errorf("%s: no such address", arg)
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown command %q", cmd)
+}
+
+// maddr  显示各设备加入的组播组以及当前使用的 igmp/mld 版本
+func maddrCtl(v *vrf, args []string) (string, error) {
+	var b strings.Builder
+	for _, dev := range devices {
+		st := dev.igmpState()
+		st.mutex.Lock()
+		fmt.Fprintf(&b, "%s igmpv%d\n", dev.name, st.versionUnlocked())
+		fmt.Fprintf(&b, "\t%-15s users -\n", net.IP(ipv4AllHosts[:]))
+		for addr, g := range st.groups {
+			fmt.Fprintf(&b, "\t%-15s users %d\n", net.IP(addr[:]), g.users)
+		}
+		st.mutex.Unlock()
+		mld := dev.mldState()
+		mld.mutex.Lock()
+		fmt.Fprintf(&b, "%s mldv%d\n", dev.name, mld.versionUnlocked())
+		fmt.Fprintf(&b, "\t%-15s users -\n", net.IP(ipv6AllNodes[:]))
+		for addr, g := range mld.groups {
+			fmt.Fprintf(&b, "\t%-15s users %d\n", net.IP(addr[:]), g.users)
+		}
+		mld.mutex.Unlock()
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+	arp [-a]              显示 ARP 缓存表
+	arp -s <ip> <mac>     添加静态表项
+	arp -d <ip>           删除表项
+	arp -F                清空动态表项
+	arp proxy [add|del <dev> <cidr>]  显示/配置 proxy ARP 网段
+	arp lock [static|learned on|off]  显示/配置表项锁定
+	arp events            显示最近的可疑 ARP 事件
+*/
+func arpCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		args = []string{"-a"}
+	}
+	switch args[0] {
+	case "-a":
+		return arpShow(v.arp), nil
+	case "-s":
+		if len(args) != 3 {
+			return "", errors.New("usage: arp -s <ip> <mac>")
+		}
+		ip, err := parseIPv4(args[1])
+		if err != nil {
+			return "", err
+		}
+		mac, err := parseMAC(args[2])
+		if err != nil {
+			return "", err
+		}
+		v.arp.insertStatic(ip, mac)
+		return "", nil
+	case "-d":
+		if len(args) != 2 {
+			return "", errors.New("usage: arp -d <ip>")
+		}
+		ip, err := parseIPv4(args[1])
+		if err != nil {
+			return "", err
+		}
+		if !v.arp.remove(ip) {
+			return "", fmt.Errorf("%s: no entry", args[1])
+		}
+		return "", nil
+	case "-F":
+		return fmt.Sprintf("%d entries flushed\n", v.arp.flush()), nil
+	case "proxy":
+		return arpProxyCtl(v, args[1:])
+	case "lock":
+		return arpLockCtl(v, args[1:])
+	case "events":
+		var b strings.Builder
+		for _, event := range v.arp.recentEvents() {
+			fmt.Fprintf(&b, "%s %-9s %-16s %v -> %v\n",
+				event.timestamp.Format(time.RFC3339), event.kind, net.IP(event.protocolAddress[:]),
+				net.HardwareAddr(event.oldHardware[:]), net.HardwareAddr(event.newHardware[:]))
+		}
+		return b.String(), nil
+	}
+	return "", fmt.Errorf("unknown option %q", args[0])
+}
+
+func arpShow(tbl *arpTable) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-16s %-18s %-8s %s\n", "Address", "HWaddress", "Flags", "Age")
+	now := time.Now()
+	for _, entry := range tbl.entries() {
+		flags, age := "dynamic", now.Sub(entry.timestamp).Truncate(time.Second).String()
+		if entry.static {
+			flags, age = "static", "-"
+		}
+		fmt.Fprintf(&b, "%-16s %-18s %-8s %s\n",
+			net.IP(entry.protocolAddress[:]), net.HardwareAddr(entry.hardwareAddress[:]), flags, age)
+	}
+	return b.String()
+}
+
+func arpProxyCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		var b strings.Builder
+		for _, entry := range v.proxyArp.entries() {
+			fmt.Fprintf(&b, "%-8s %s\n", entry.dev.name, entry.prefix)
+		}
+		return b.String(), nil
+	}
+	if len(args) != 3 || args[0] != "add" && args[0] != "del" {
+		return "", errors.New("usage: arp proxy [add|del <dev> <cidr>]")
+	}
+	dev := deviceByName(args[1])
+	if dev == nil {
+		return "", fmt.Errorf("%s: no such device", args[1])
+	}
+	if dev.vrf() != v {
+		return "", fmt.Errorf("%s is not in vrf %s", dev.name, v.name)
+	}
+	prefix, err := parseIPv4Prefix(args[2])
+	if err != nil {
+		return "", err
+	}
+	if args[0] == "add" && !v.proxyArp.add(dev, prefix) {
+		return "", fmt.Errorf("%s %s: already exists", args[1], prefix)
+	}
+	if args[0] == "del" && !v.proxyArp.remove(dev, prefix) {
+		return "", fmt.Errorf("%s %s: no such entry", args[1], prefix)
+	}
+	return "", nil
+}
+
+func arpLockCtl(v *vrf, args []string) (string, error) {
+	static, learned := v.arp.getLock()
+	if len(args) == 0 {
+		return fmt.Sprintf("static %v\nlearned %v\n", static, learned), nil
+	}
+	if len(args) != 2 || args[1] != "on" && args[1] != "off" {
+		return "", errors.New("usage: arp lock [static|learned on|off]")
+	}
+	switch args[0] {
+	case "static":
+		static = args[1] == "on"
+	case "learned":
+		learned = args[1] == "on"
+	default:
+		return "", fmt.Errorf("unknown lock %q", args[0])
+	}
+	v.arp.setLock(static, learned)
+	return "", nil
+}
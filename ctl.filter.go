@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+	以下设置和计数都只作用于当前 VRF
+	filter                        显示反向路径过滤模式和各原因的丢弃计数
+	filter rp off|strict|loose    设置反向路径过滤模式
+	filter log on|off             是否输出被丢弃的 martian 数据报
+	filter reset                  清空计数
+*/
+func filterCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		mode, logging, drops := v.filter.stats()
+		var b strings.Builder
+		fmt.Fprintf(&b, "rp %s log %v\n", mode, logging)
+		for reason := martianNone + 1; reason < martianReasonMax; reason++ {
+			fmt.Fprintf(&b, "%-18s %d\n", reason, drops[reason])
+		}
+		return b.String(), nil
+	}
+	switch {
+	case args[0] == "reset" && len(args) == 1:
+		v.filter.resetStats()
+	case args[0] == "rp" && len(args) == 2:
+		switch args[1] {
+		case "off":
+			v.filter.setRPFilter(rpFilterOff)
+		case "strict":
+			v.filter.setRPFilter(rpFilterStrict)
+		case "loose":
+			v.filter.setRPFilter(rpFilterLoose)
+		default:
+			return "", errors.New("usage: filter rp off|strict|loose")
+		}
+	case args[0] == "log" && len(args) == 2 && (args[1] == "on" || args[1] == "off"):
+		v.filter.setLogMartians(args[1] == "on")
+	default:
+		return "", errors.New("usage: filter [rp off|strict|loose | log on|off | reset]")
+	}
+	return "", nil
+}
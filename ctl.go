@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// 协议栈运行时通过 unix socket 接收管理命令, 每个连接只处理一行命令
+const ctlSocketPath = "/tmp/netp.sock"
+
+// 命令在 VRF v 中执行, 不指定时为 defaultVRF, 与 VRF 无关的命令忽略 v
+type ctlHandler func(v *vrf, args []string) (string, error)
+
+var ctlCommands = map[string]ctlHandler{
+	"arp":     arpCtl,
+	"addr":    addrCtl,
+	"link":    linkCtl,
+	"maddr":   maddrCtl,
+	"neigh":   neighCtl,
+	"ping":    pingCtl,
+	"route":   routeCtl,
+	"route6":  route6Ctl,
+	"rule":    ruleCtl,
+	"forward": forwardCtl,
+	"filter":  filterCtl,
+	"vrf":     vrfCtl,
+}
+
+func serveCtl(sig chan struct{}) {
+	os.Remove(ctlSocketPath)
+	ln, err := net.Listen("unix", ctlSocketPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	go func() {
+		<-sig
+		ln.Close()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handleCtl(c)
+	}
+}
+
+func handleCtl(c net.Conn) {
+	defer c.Close()
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+	v := defaultVRF
+	if len(args) > 3 && args[0] == "vrf" && args[1] == "exec" { // vrf exec <name> <command...>
+		if v = vrfByName(args[2]); v == nil {
+			fmt.Fprintf(c, "error: %s: no such vrf\n", args[2])
+			return
+		}
+		args = args[3:]
+	}
+	handler, ok := ctlCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(c, "unknown command %q\n", args[0])
+		return
+	}
+	out, err := handler(v, args[1:])
+	if err != nil {
+		fmt.Fprintf(c, "error: %v\n", err)
+		return
+	}
+	fmt.Fprint(c, out)
+}
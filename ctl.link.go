@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	link                        显示各设备的 mac 和 MTU
+	link set <dev> mtu <mtu>    修改设备的 MTU, 同时修改系统中网卡的 MTU
+*/
+func linkCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		var b strings.Builder
+		for _, dev := range devices {
+			fmt.Fprintf(&b, "%s: mtu %d ipv6 mtu %d\n", dev.name, dev.linkMTU(), dev.ipv6MTU())
+		}
+		return b.String(), nil
+	}
+	if len(args) != 4 || args[0] != "set" || args[2] != "mtu" {
+		return "", errors.New("usage: link [set <dev> mtu <mtu>]")
+	}
+	dev := deviceByName(args[1])
+	if dev == nil {
+		return "", fmt.Errorf("%s: no such device", args[1])
+	}
+	mtu, err := strconv.Atoi(args[3])
+	if err != nil {
+		return "", fmt.Errorf("invalid mtu %q", args[3])
+	}
+	if mtu < deviceMinMTU || mtu > deviceMaxMTU {
+		return "", fmt.Errorf("mtu must be between %d and %d", deviceMinMTU, deviceMaxMTU)
+	}
+	if err = SetLinkMTU(dev.name, mtu); err != nil {
+		return "", err
+	}
+	return "", dev.setMTU(mtu)
+}
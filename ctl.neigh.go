@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+	neigh                          显示 ipv6 邻居缓存
+	neigh add <dev> <ip6> <mac>    添加静态表项
+	neigh del <dev> <ip6>          删除表项
+	neigh flush                    清空动态表项
+*/
+func neighCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		return neighShow(v.ndp), nil
+	}
+	switch args[0] {
+	case "add":
+		if len(args) != 4 {
+			return "", errors.New("usage: neigh add <dev> <ip6> <mac>")
+		}
+		dev, addr, err := neighTarget(args[1], args[2])
+		if err != nil {
+			return "", err
+		}
+		mac, err := parseMAC(args[3])
+		if err != nil {
+			return "", err
+		}
+		v.ndp.insertStatic(dev, addr, mac)
+		v.pending6.resolved(dev, addr)
+		return "", nil
+	case "del":
+		if len(args) != 3 {
+			return "", errors.New("usage: neigh del <dev> <ip6>")
+		}
+		dev, addr, err := neighTarget(args[1], args[2])
+		if err != nil {
+			return "", err
+		}
+		if !v.ndp.remove(dev, addr) {
+			return "", fmt.Errorf("%s: no entry", args[2])
+		}
+		return "", nil
+	case "flush":
+		return fmt.Sprintf("%d entries flushed\n", v.ndp.flush()), nil
+	}
+	return "", fmt.Errorf("unknown command %q", args[0])
+}
+
+func neighTarget(name, ip string) (*device, [16]byte, error) {
+	dev := deviceByName(name)
+	if dev == nil {
+		return nil, [16]byte{}, fmt.Errorf("%s: no such device", name)
+	}
+	addr, err := parseIPv6(ip)
+	return dev, addr, err
+}
+
+func neighShow(tbl *ndpTable) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-26s %-6s %-18s %-8s %s\n", "Address", "Dev", "HWaddress", "Flags", "Age")
+	now := time.Now()
+	for _, entry := range tbl.entries() {
+		flags, age := "dynamic", now.Sub(entry.timestamp).Truncate(time.Second).String()
+		if entry.static {
+			flags, age = "static", "-"
+		}
+		if entry.isRouter {
+			flags += ",router"
+		}
+		fmt.Fprintf(&b, "%-26s %-6s %-18s %-8s %s\n",
+			net.IP(entry.protocolAddress[:]), entry.dev.name, net.HardwareAddr(entry.hardwareAddress[:]), flags, age)
+	}
+	return b.String()
+}
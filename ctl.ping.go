@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+/*
+	ping [-c count] [-s size] [-i interval] <addr>
+	在命令所在的 VRF 中 ping, 默认发送 4 个请求, 数据部分 56 字节, 间隔 1 秒 (interval 的单位是秒, 可以是小数)
+	所有请求结束后一次返回结果
+*/
+func pingCtl(v *vrf, args []string) (string, error) {
+	usage := errors.New("usage: ping [-c count] [-s size] [-i interval] <addr>")
+	count, size, interval := 4, pingDefaultSize, time.Second
+	var target string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-c", "-s", "-i":
+			if i+1 >= len(args) {
+				return "", usage
+			}
+			var err error
+			switch args[i] {
+			case "-c":
+				count, err = strconv.Atoi(args[i+1])
+			case "-s":
+				size, err = strconv.Atoi(args[i+1])
+			case "-i":
+				var seconds float64
+				seconds, err = strconv.ParseFloat(args[i+1], 64)
+				interval = time.Duration(seconds * float64(time.Second))
+			}
+			if err != nil {
+				return "", usage
+			}
+			i++
+		default:
+			if target != "" {
+				return "", usage
+			}
+			target = args[i]
+		}
+	}
+	if target == "" {
+		return "", usage
+	}
+	dst, err := parseIPv4(target)
+	if err != nil {
+		return "", err
+	}
+	stats, err := v.ping(dst, count, size, interval)
+	if err != nil {
+		return "", err
+	}
+	return stats.String(), nil
+}
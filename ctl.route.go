@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+	route [table <table|all>]                                显示路由表, 默认显示 main 表
+	route add <cidr|default> [via <gateway>] [dev <dev>] [metric <n>] [table <table>]  添加路由
+	route del <cidr|default> [metric <n>] [table <table>]    删除路由
+	forward [on|off]                                         显示/开关 ip 转发
+	table 可以是编号或者 local, main, default
+*/
+func routeCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		return routeShow(v.rules.table(ipv4TableMain, true)), nil
+	}
+	if args[0] == "table" && len(args) == 2 {
+		if args[1] == "all" {
+			var b strings.Builder
+			for _, id := range v.rules.tableIDs() {
+				fmt.Fprintf(&b, "table %s:\n%s", routeTableName(id), routeShow(v.rules.table(id, false)))
+			}
+			return b.String(), nil
+		}
+		id, err := parseRouteTable(args[1])
+		if err != nil {
+			return "", err
+		}
+		tbl := v.rules.table(id, false)
+		if tbl == nil {
+			return "", fmt.Errorf("table %s does not exist", args[1])
+		}
+		return routeShow(tbl), nil
+	}
+	if len(args) < 2 {
+		return "", errors.New("usage: route [add|del <cidr|default> ...]")
+	}
+	prefix, err := parseRoutePrefix(args[1])
+	if err != nil {
+		return "", err
+	}
+	route := &ipv4Route{prefix: prefix, metric: -1}
+	table := ipv4TableMain
+	for i := 2; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "table":
+			if table, err = parseRouteTable(args[i+1]); err != nil {
+				return "", err
+			}
+		case "via":
+			if route.gateway, err = parseIPv4(args[i+1]); err != nil {
+				return "", err
+			}
+		case "dev":
+			if route.dev = deviceByName(args[i+1]); route.dev == nil {
+				return "", fmt.Errorf("%s: no such device", args[i+1])
+			}
+		case "metric":
+			if route.metric, err = strconv.Atoi(args[i+1]); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("unknown option %q", args[i])
+		}
+	}
+	switch args[0] {
+	case "add":
+		if route.metric < 0 {
+			route.metric = 0
+		}
+		if route.dev == nil && route.gateway != [4]byte{} {
+			// 没有指定设备时, 使用到达网关的直连路由的设备
+			if r, _ := v.rules.lookup(ipv4FlowKey{dst: route.gateway}); r != nil && r.gateway == [4]byte{} {
+				route.dev = r.dev
+			}
+		}
+		if route.dev == nil {
+			return "", errors.New("route needs a device or a reachable gateway")
+		}
+		if route.dev.vrf() != v {
+			return "", fmt.Errorf("%s is not in vrf %s", route.dev.name, v.name)
+		}
+		return "", v.rules.table(table, true).add(route)
+	case "del":
+		tbl := v.rules.table(table, false)
+		if tbl == nil || !tbl.remove(prefix, route.metric) {
+			return "", fmt.Errorf("%s: no such route", prefix)
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown command %q", args[0])
+}
+
+func parseRoutePrefix(s string) (ipv4Prefix, error) {
+	if s == "default" {
+		return ipv4Prefix{}, nil
+	}
+	return parseIPv4Prefix(s)
+}
+
+func parseRouteTable(s string) (int, error) {
+	switch s {
+	case "local":
+		return ipv4TableLocal, nil
+	case "main":
+		return ipv4TableMain, nil
+	case "default":
+		return ipv4TableDefault, nil
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid table %q", s)
+	}
+	return id, nil
+}
+
+func routeTableName(id int) string {
+	switch id {
+	case ipv4TableLocal:
+		return "local"
+	case ipv4TableMain:
+		return "main"
+	case ipv4TableDefault:
+		return "default"
+	}
+	return strconv.Itoa(id)
+}
+
+func routeShow(tbl *ipv4RouteTable) string {
+	var b strings.Builder
+	for _, r := range tbl.entries() {
+		if r.prefix.len == 0 {
+			fmt.Fprint(&b, "default")
+		} else {
+			fmt.Fprint(&b, r.prefix)
+		}
+		if r.gateway != [4]byte{} {
+			fmt.Fprintf(&b, " via %v", net.IP(r.gateway[:]))
+		}
+		fmt.Fprintf(&b, " dev %s", r.dev.name)
+		if r.connected {
+			fmt.Fprint(&b, " proto kernel scope link")
+		}
+		fmt.Fprintf(&b, " metric %d\n", r.metric)
+	}
+	return b.String()
+}
+
+func forwardCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		return fmt.Sprintf("forward %v\n", ipv4ForwardingEnabled()), nil
+	}
+	switch args[0] {
+	case "on":
+		setIPv4Forwarding(true)
+	case "off":
+		setIPv4Forwarding(false)
+	default:
+		return "", errors.New("usage: forward [on|off]")
+	}
+	return "", nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+	route6                                                   显示 ipv6 路由表
+	route6 add <cidr|default> [via <gateway>] dev <dev> [metric <n>]  添加路由
+	route6 del <cidr|default> [metric <n>]                   删除路由
+	ipv6 的网关一般是链路本地地址, 不能由网关推断出设备, 所以添加路由时必须指定设备
+*/
+func route6Ctl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		return route6Show(v.routes6), nil
+	}
+	if len(args) < 2 {
+		return "", errors.New("usage: route6 [add|del <cidr|default> ...]")
+	}
+	var prefix ipv6Prefix
+	if args[1] != "default" {
+		var err error
+		if prefix, err = parseIPv6Prefix(args[1]); err != nil {
+			return "", err
+		}
+	}
+	route := &ipv6Route{prefix: prefix, metric: -1}
+	for i := 2; i+1 < len(args); i += 2 {
+		var err error
+		switch args[i] {
+		case "via":
+			route.gateway, err = parseIPv6(args[i+1])
+		case "dev":
+			if route.dev = deviceByName(args[i+1]); route.dev == nil {
+				err = fmt.Errorf("%s: no such device", args[i+1])
+			}
+		case "metric":
+			route.metric, err = strconv.Atoi(args[i+1])
+		default:
+			err = fmt.Errorf("unknown option %q", args[i])
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	switch args[0] {
+	case "add":
+		if route.metric < 0 {
+			route.metric = 0
+		}
+		if route.dev == nil {
+			return "", errors.New("route6 needs a device")
+		}
+		if route.dev.vrf() != v {
+			return "", fmt.Errorf("%s is not in vrf %s", route.dev.name, v.name)
+		}
+		return "", v.routes6.add(route)
+	case "del":
+		if !v.routes6.remove(prefix, route.metric) {
+			return "", fmt.Errorf("%s: no such route", prefix)
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown command %q", args[0])
+}
+
+func route6Show(tbl *ipv6RouteTable) string {
+	var b strings.Builder
+	for _, r := range tbl.entries() {
+		if r.prefix.len == 0 {
+			fmt.Fprint(&b, "default")
+		} else {
+			fmt.Fprint(&b, r.prefix)
+		}
+		if r.gateway != ipv6Unspecified {
+			fmt.Fprintf(&b, " via %v", net.IP(r.gateway[:]))
+		}
+		fmt.Fprintf(&b, " dev %s", r.dev.name)
+		if r.connected {
+			fmt.Fprint(&b, " proto kernel")
+		} else if r.redirect {
+			fmt.Fprint(&b, " proto redirect")
+		}
+		fmt.Fprintf(&b, " metric %d\n", r.metric)
+	}
+	return b.String()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	rule                                   显示策略路由规则
+	rule add [from <cidr>] [iif <dev>] [tos <n>] [fwmark <n>[/<mask>]] [priority <n>] table <table>
+	rule del priority <n>                  删除规则
+*/
+func ruleCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		return ruleShow(v.rules), nil
+	}
+	switch {
+	case args[0] == "del" && len(args) == 3 && args[1] == "priority":
+		priority, err := strconv.Atoi(args[2])
+		if err != nil {
+			return "", err
+		}
+		if !v.rules.remove(func(r *ipv4Rule) bool { return r.priority == priority }) {
+			return "", fmt.Errorf("no rule with priority %d", priority)
+		}
+		return "", nil
+	case args[0] != "add" || len(args)%2 != 1:
+		return "", errors.New("usage: rule [add <selector> table <table> | del priority <n>]")
+	}
+	rule := &ipv4Rule{}
+	for i := 1; i+1 < len(args); i += 2 {
+		var err error
+		switch value := args[i+1]; args[i] {
+		case "from":
+			if value == "all" {
+				break
+			}
+			if !strings.Contains(value, "/") {
+				value += "/32"
+			}
+			rule.src, err = parseIPv4Prefix(value)
+		case "iif":
+			if rule.iif = deviceByName(value); rule.iif == nil {
+				err = fmt.Errorf("%s: no such device", value)
+			} else if rule.iif.vrf() != v {
+				err = fmt.Errorf("%s is not in vrf %s", value, v.name)
+			}
+		case "tos":
+			var tos uint64
+			tos, err = strconv.ParseUint(value, 0, 8)
+			rule.tos = uint8(tos)
+		case "fwmark":
+			rule.mark, rule.mask, err = parseFwmark(value)
+		case "priority", "pref":
+			rule.priority, err = strconv.Atoi(value)
+		case "table", "lookup":
+			rule.table, err = parseRouteTable(value)
+		default:
+			err = fmt.Errorf("unknown option %q", args[i])
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", v.rules.add(rule)
+}
+
+// fwmark 的格式为 mark 或 mark/mask, 没有 mask 时比较全部 32 位
+func parseFwmark(s string) (mark, mask uint32, err error) {
+	markStr, maskStr := s, "0xffffffff"
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		markStr, maskStr = s[:i], s[i+1:]
+	}
+	m, err := strconv.ParseUint(markStr, 0, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	k, err := strconv.ParseUint(maskStr, 0, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(m), uint32(k), nil
+}
+
+func ruleShow(rules *ipv4RuleList) string {
+	var b strings.Builder
+	for _, r := range rules.entries() {
+		fmt.Fprintf(&b, "%d:\tfrom ", r.priority)
+		if r.src.len == 0 {
+			fmt.Fprint(&b, "all")
+		} else {
+			fmt.Fprint(&b, r.src)
+		}
+		if r.iif != nil {
+			fmt.Fprintf(&b, " iif %s", r.iif.name)
+		}
+		if r.tos != 0 {
+			fmt.Fprintf(&b, " tos 0x%02x", r.tos)
+		}
+		if r.mask != 0 {
+			fmt.Fprintf(&b, " fwmark 0x%x/0x%x", r.mark, r.mask)
+		}
+		fmt.Fprintf(&b, " lookup %s\n", routeTableName(r.table))
+	}
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+	vrf                           显示所有 VRF 以及其中的设备
+	vrf add <name>                新建 VRF
+	vrf del <name>                删除没有设备的 VRF
+	vrf set <dev> <name>          把设备移到 VRF 中, name 为 default 时移回默认 VRF
+	vrf exec <name> <command...>  在 VRF 中执行 arp, route, rule 等命令, 由 handleCtl 处理
+*/
+func vrfCtl(v *vrf, args []string) (string, error) {
+	if len(args) == 0 {
+		var b strings.Builder
+		for _, v := range vrfList() {
+			fmt.Fprintf(&b, "%s:", v.name)
+			for _, dev := range v.devices() {
+				fmt.Fprintf(&b, " %s", dev.name)
+			}
+			fmt.Fprintln(&b)
+		}
+		return b.String(), nil
+	}
+	switch {
+	case args[0] == "add" && len(args) == 2:
+		_, err := newVRF(args[1])
+		return "", err
+	case args[0] == "del" && len(args) == 2:
+		return "", removeVRF(args[1])
+	case args[0] == "set" && len(args) == 3:
+		dev := deviceByName(args[1])
+		if dev == nil {
+			return "", fmt.Errorf("%s: no such device", args[1])
+		}
+		target := vrfByName(args[2])
+		if target == nil {
+			return "", fmt.Errorf("%s: no such vrf", args[2])
+		}
+		dev.setVRF(target)
+		return "", nil
+	}
+	return "", errors.New("usage: vrf [add|del <name> | set <dev> <name> | exec <name> <command...>]")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+/*
+	设备上的 ipv4 地址, 一个设备可以有多个地址, 每个地址都带有网段
+	地址需要先通过冲突检测 (acd) 才能使用, 设备会接收发给它任意一个可用地址,
+	以及受限广播 (255.255.255.255) 和各个网段的定向广播的数据报
+*/
+type ipv4Address struct {
+	addr   [4]byte
+	prefix ipv4Prefix // 地址所在的网段, prefix.addr 是网络号
+	acd    *acd
+}
+
+var ipv4LimitedBroadcast = [4]byte{255, 255, 255, 255}
+
+// 网段的定向广播地址, /31 和 /32 没有广播地址
+func (a *ipv4Address) broadcast() ([4]byte, bool) {
+	if a.prefix.len >= 31 {
+		return [4]byte{}, false
+	}
+	var b [4]byte
+	m := a.prefix.mask()
+	for i := range b {
+		b[i] = a.addr[i] | ^byte(m>>(24-8*i))
+	}
+	return b, true
+}
+
+// 添加一个地址以及对应的直连路由, 地址处于 probing 状态, 由调用者启动冲突检测
+func (dev *device) addIPv4(addr [4]byte, prefixLen uint8) (*ipv4Address, error) {
+	if prefixLen > 32 {
+		return nil, errors.New("invalid prefix length")
+	}
+	prefix := ipv4Prefix{addr: addr, len: prefixLen}
+	prefix.addr = maskIPv4(addr, prefix)
+	entry := &ipv4Address{addr: addr, prefix: prefix}
+	entry.acd = newAcd(dev, addr)
+
+	dev.mutex.Lock()
+	for _, a := range dev.ipv4Addrs {
+		if a.addr == addr {
+			dev.mutex.Unlock()
+			return nil, errors.New("address already exists")
+		}
+	}
+	dev.ipv4Addrs = append(dev.ipv4Addrs, entry)
+	dev.mutex.Unlock()
+
+	dev.addConnectedRoute(prefix)
+	return entry, nil
+}
+
+// 删除地址, 该网段没有其它地址时一并删除直连路由
+func (dev *device) removeIPv4(addr [4]byte) bool {
+	dev.mutex.Lock()
+	var removed *ipv4Address
+	for i, a := range dev.ipv4Addrs {
+		if a.addr == addr {
+			removed = a
+			dev.ipv4Addrs = append(dev.ipv4Addrs[:i], dev.ipv4Addrs[i+1:]...)
+			break
+		}
+	}
+	shared := false
+	for _, a := range dev.ipv4Addrs {
+		if removed != nil && a.prefix == removed.prefix {
+			shared = true
+		}
+	}
+	dev.mutex.Unlock()
+	if removed == nil {
+		return false
+	}
+	removed.acd.stop()
+	if !shared {
+		dev.vrf().rules.table(ipv4TableMain, true).removeConnected(dev, removed.prefix)
+	}
+	return true
+}
+
+// 返回地址列表的快照
+func (dev *device) ipv4Addresses() []ipv4Address {
+	dev.mutex.RLock()
+	defer dev.mutex.RUnlock()
+	list := make([]ipv4Address, 0, len(dev.ipv4Addrs))
+	for _, a := range dev.ipv4Addrs {
+		list = append(list, *a)
+	}
+	return list
+}
+
+// addr 是否是设备的地址, 且已经通过冲突检测
+func (dev *device) ownsIPv4(addr [4]byte) bool {
+	for _, a := range dev.ipv4Addresses() {
+		if a.addr == addr && a.acd.usable() {
+			return true
+		}
+	}
+	return false
+}
+
+// addr 是否是受限广播, 或者设备某个网段的定向广播
+func (dev *device) isIPv4Broadcast(addr [4]byte) bool {
+	if addr == ipv4LimitedBroadcast {
+		return true
+	}
+	for _, a := range dev.ipv4Addresses() {
+		if b, ok := a.broadcast(); ok && b == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// 交给所有地址的冲突检测, 任意一个地址冲突时返回 true
+func (dev *device) checkConflict(f *arp) bool {
+	conflict := false
+	for _, a := range dev.ipv4Addresses() {
+		if a.acd.check(f) {
+			conflict = true
+		}
+	}
+	return conflict
+}
+
+/*
+	为本地发出的数据报选择源地址
+	优先选择与 dst (或下一跳) 在同一网段的可用地址, 否则选择第一个可用地址, 都没有时返回 0.0.0.0
+*/
+func (dev *device) selectSourceIPv4(dst [4]byte) [4]byte {
+	var primary [4]byte
+	for _, a := range dev.ipv4Addresses() {
+		if !a.acd.usable() {
+			continue
+		}
+		if a.prefix.contains(dst) {
+			return a.addr
+		}
+		if primary == [4]byte{} {
+			primary = a.addr
+		}
+	}
+	return primary
+}
+
+func parseIPv4Address(s string) ([4]byte, uint8, error) {
+	var addr [4]byte
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil || ip.To4() == nil {
+		return addr, 0, errors.New("invalid ipv4 address " + s)
+	}
+	ones, _ := ipnet.Mask.Size()
+	copy(addr[:], ip.To4())
+	return addr, uint8(ones), nil
+}
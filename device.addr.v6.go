@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+/*
+	设备上的 ipv6 地址
+	与 ipv4 不同, 一个设备通常同时有链路本地地址 (fe80::/64) 和若干全局地址,
+	发往链路本地地址或者链路范围组播的数据报必须使用链路本地地址作为源地址
+	新地址先处于 tentative 状态, 通过重复地址检测 (DAD) 后才能使用
+*/
+type ipv6Address struct {
+	addr   [16]byte
+	prefix ipv6Prefix // 地址所在的网段, prefix.addr 是网络号
+	state  ipv6AddrState
+
+	// 以下字段只用于自动配置的地址, 到期时间为零值表示永久
+	autoconf       bool
+	dadCounter     uint8
+	validUntil     time.Time
+	preferredUntil time.Time
+}
+
+type ipv6AddrState uint8
+
+const (
+	ipv6AddrTentative  ipv6AddrState = iota // 正在进行 DAD, 只接收发给它的 NS/NA
+	ipv6AddrPreferred                       // 可以使用
+	ipv6AddrDeprecated                      // preferred 生存期已过, 尽量不作为源地址
+	ipv6AddrDuplicate                       // DAD 失败, 不能使用
+)
+
+func (s ipv6AddrState) String() string {
+	switch s {
+	case ipv6AddrTentative:
+		return "tentative"
+	case ipv6AddrPreferred:
+		return "preferred"
+	case ipv6AddrDeprecated:
+		return "deprecated"
+	}
+	return "dadfailed"
+}
+
+const (
+	ndpDadTransmits = 1 // DupAddrDetectTransmits
+	ndpRetransTimer = time.Second
+	ndpMaxDadDelay  = time.Second // 发送第一个 NS 之前的随机延迟, 避免多个节点同时启动时冲突
+)
+
+var (
+	ipv6Unspecified  = [16]byte{}
+	ipv6AllNodes     = [16]byte{0xff, 0x02, 15: 0x01}
+	ipv6AllRouters   = [16]byte{0xff, 0x02, 15: 0x02}
+	ipv6LinkLocalNet = ipv6Prefix{addr: [16]byte{0xfe, 0x80}, len: 10}
+)
+
+func ipv6IsMulticast(addr [16]byte) bool {
+	return addr[0] == 0xff
+}
+
+func ipv6IsLinkLocal(addr [16]byte) bool {
+	return ipv6LinkLocalNet.contains(addr)
+}
+
+// 链路本地单播, 或者范围不超过链路的组播 (ff01::/16, ff02::/16)
+func ipv6IsLinkScope(addr [16]byte) bool {
+	if ipv6IsMulticast(addr) {
+		return addr[1]&0x0f <= 2
+	}
+	return ipv6IsLinkLocal(addr)
+}
+
+// 添加一个地址以及对应的直连路由, 地址处于 tentative 状态, 由调用者启动 DAD
+func (dev *device) addIPv6(addr [16]byte, prefixLen uint8) (*ipv6Address, error) {
+	if prefixLen > 128 {
+		return nil, errors.New("invalid prefix length")
+	}
+	if addr == ipv6Unspecified || ipv6IsMulticast(addr) {
+		return nil, errors.New("invalid ipv6 address")
+	}
+	prefix := ipv6Prefix{addr: maskIPv6(addr, prefixLen), len: prefixLen}
+	entry := &ipv6Address{addr: addr, prefix: prefix, state: ipv6AddrTentative}
+
+	dev.mutex.Lock()
+	for _, a := range dev.ipv6Addrs {
+		if a.addr == addr {
+			dev.mutex.Unlock()
+			return nil, errors.New("address already exists")
+		}
+	}
+	dev.ipv6Addrs = append(dev.ipv6Addrs, entry)
+	dev.mutex.Unlock()
+
+	// 在开始 DAD 之前加入 solicited-node 组, 才能收到针对该地址的 NS
+	dev.joinIPv6Group(ipv6SolicitedNode(addr))
+
+	dev.vrf().routes6.add(&ipv6Route{prefix: prefix, dev: dev, connected: true})
+	return entry, nil
+}
+
+// 删除地址, 该网段没有其它地址时一并删除直连路由
+func (dev *device) removeIPv6(addr [16]byte) bool {
+	dev.mutex.Lock()
+	var removed *ipv6Address
+	for i, a := range dev.ipv6Addrs {
+		if a.addr == addr {
+			removed = a
+			dev.ipv6Addrs = append(dev.ipv6Addrs[:i], dev.ipv6Addrs[i+1:]...)
+			break
+		}
+	}
+	shared := false
+	for _, a := range dev.ipv6Addrs {
+		if removed != nil && a.prefix == removed.prefix {
+			shared = true
+		}
+	}
+	dev.mutex.Unlock()
+	if removed == nil {
+		return false
+	}
+	dev.leaveIPv6Group(ipv6SolicitedNode(addr))
+	if !shared {
+		dev.vrf().routes6.removeConnected(dev, removed.prefix)
+	}
+	return true
+}
+
+// 返回地址列表的快照
+func (dev *device) ipv6Addresses() []ipv6Address {
+	dev.mutex.RLock()
+	defer dev.mutex.RUnlock()
+	list := make([]ipv6Address, 0, len(dev.ipv6Addrs))
+	for _, a := range dev.ipv6Addrs {
+		list = append(list, *a)
+	}
+	return list
+}
+
+// 通过了 DAD 且没有过期的地址可以使用
+func (a *ipv6Address) usable() bool {
+	return a.state == ipv6AddrPreferred || a.state == ipv6AddrDeprecated
+}
+
+// addr 是否是设备的地址, 且可以使用
+func (dev *device) ownsIPv6(addr [16]byte) bool {
+	for _, a := range dev.ipv6Addresses() {
+		if a.addr == addr {
+			return a.usable()
+		}
+	}
+	return false
+}
+
+func (dev *device) ipv6AddressState(addr [16]byte) (ipv6AddrState, bool) {
+	dev.mutex.RLock()
+	defer dev.mutex.RUnlock()
+	for _, a := range dev.ipv6Addrs {
+		if a.addr == addr {
+			return a.state, true
+		}
+	}
+	return 0, false
+}
+
+/*
+	设备是否接收目的地址为 addr 的数据报
+	单播只接收可用的地址, tentative 地址的 NS/NA 在 handleNeighborSolicit 等处单独处理
+	组播只接收加入了的组, 包括每个地址 (包括 tentative 的) 对应的 solicited-node 组
+*/
+func (dev *device) acceptsIPv6(addr [16]byte) bool {
+	if ipv6IsMulticast(addr) {
+		return dev.inIPv6Group(addr)
+	}
+	state, ok := dev.ipv6AddressState(addr)
+	return ok && state != ipv6AddrDuplicate
+}
+
+// 把 tentative 的地址改为 state, 地址已经被删除或者不是 tentative 时返回 false
+func (dev *device) settleIPv6(addr [16]byte, state ipv6AddrState) bool {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	for _, a := range dev.ipv6Addrs {
+		if a.addr == addr && a.state == ipv6AddrTentative {
+			a.state = state
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	重复地址检测 (RFC 4862 5.4)
+	随机延迟之后, 以 :: 为源地址向 addr 的 solicited-node 组发送 NS, 等待 RetransTimer
+	期间收到针对 addr 的 NA, 或者别人对 addr 的 DAD NS, 说明地址冲突, 由 dadFailed 处理
+*/
+func (dev *device) startDAD(addr [16]byte, sig chan struct{}) {
+	delay := time.Duration(rand.Int63n(int64(ndpMaxDadDelay)))
+	for i := 0; i < ndpDadTransmits; i++ {
+		select {
+		case <-sig:
+			return
+		case <-time.After(delay):
+		}
+		if state, ok := dev.ipv6AddressState(addr); !ok || state != ipv6AddrTentative {
+			return
+		}
+		dev.sendNeighborSolicit(addr, true)
+		delay = ndpRetransTimer
+	}
+	select {
+	case <-sig:
+		return
+	case <-time.After(delay):
+	}
+	if dev.settleIPv6(addr, ipv6AddrPreferred) {
+		fmt.Printf("%s: %v is preferred\n", dev.name, net.IP(addr[:]))
+	}
+}
+
+func (dev *device) dadFailed(addr [16]byte) {
+	if !dev.settleIPv6(addr, ipv6AddrDuplicate) {
+		return
+	}
+	log.Printf("%s: duplicate address %v, dad failed", dev.name, net.IP(addr[:]))
+	for _, a := range dev.ipv6Addresses() {
+		if a.addr == addr {
+			dev.regenerateIPv6(&a)
+		}
+	}
+}
+
+// 对设备上所有 tentative 的地址启动 DAD
+func (dev *device) startIPv6DAD(sig chan struct{}) {
+	for _, a := range dev.ipv6Addresses() {
+		if a.state == ipv6AddrTentative {
+			go dev.startDAD(a.addr, sig)
+		}
+	}
+}
+
+/*
+	为本地发出的数据报选择源地址 (RFC 6724 的简化版本)
+	1. 目的地址是链路范围的, 选择链路本地地址
+	2. 否则优先选择非链路本地的地址, 其中与目的地址相同前缀最长的
+	只考虑 preferred 的地址, 都没有时退而选择任意可用的地址, 仍然没有时返回 ::
+*/
+func (dev *device) selectSourceIPv6(dst [16]byte) [16]byte {
+	best, bestLen := ipv6Unspecified, -1
+	linkScope := ipv6IsLinkScope(dst)
+	for _, a := range dev.ipv6Addresses() {
+		if a.state != ipv6AddrPreferred || ipv6IsLinkLocal(a.addr) != linkScope {
+			continue
+		}
+		if n := commonPrefixLenIPv6(a.addr, dst); n > bestLen {
+			best, bestLen = a.addr, n
+		}
+	}
+	if best == ipv6Unspecified {
+		for _, a := range dev.ipv6Addresses() {
+			if a.usable() {
+				return a.addr
+			}
+		}
+	}
+	return best
+}
+
+func parseIPv6Address(s string) ([16]byte, uint8, error) {
+	var addr [16]byte
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil || ip.To4() != nil {
+		return addr, 0, errors.New("invalid ipv6 address " + s)
+	}
+	ones, _ := ipnet.Mask.Size()
+	copy(addr[:], ip.To16())
+	return addr, uint8(ones), nil
+}
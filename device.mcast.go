@@ -0,0 +1,57 @@
+package main
+
+/*
+	以太网组播过滤
+	网卡只接收加入了的组播组对应的组播 mac
+	ipv4 组播 mac 是 01:00:5e 加上组地址的低 23 位, ipv6 是 33:33 加上组地址的低 32 位
+	多个组可能映射到同一个 mac, 所以按引用计数管理
+*/
+func ipv4IsMulticast(addr [4]byte) bool {
+	return addr[0]>>4 == 14 // 224.0.0.0/4
+}
+
+func ipv4MulticastMAC(group [4]byte) [6]byte {
+	return [6]byte{0x01, 0x00, 0x5e, group[1] & 0x7f, group[2], group[3]}
+}
+
+// 组播地址映射到 33:33 加上地址的低 32 位
+func ipv6MulticastMAC(group [16]byte) [6]byte {
+	return [6]byte{0x33, 0x33, group[12], group[13], group[14], group[15]}
+}
+
+func (dev *device) addMulticastMAC(mac [6]byte) {
+	dev.mcastMutex.Lock()
+	defer dev.mcastMutex.Unlock()
+	if dev.mcastMACs == nil {
+		dev.mcastMACs = make(map[[6]byte]int)
+	}
+	dev.mcastMACs[mac]++
+}
+
+func (dev *device) delMulticastMAC(mac [6]byte) {
+	dev.mcastMutex.Lock()
+	defer dev.mcastMutex.Unlock()
+	if dev.mcastMACs[mac] <= 1 {
+		delete(dev.mcastMACs, mac)
+		return
+	}
+	dev.mcastMACs[mac]--
+}
+
+// 是否接收目的 mac 为 dst 的帧, 单播和广播总是接收
+func (dev *device) acceptFrame(dst [6]byte) bool {
+	if dst[0]&1 == 0 || dst == ethBroadcast {
+		return true
+	}
+	ipv4 := dst[0] == 0x01 && dst[1] == 0x00 && dst[2] == 0x5e
+	ipv6 := dst[0] == 0x33 && dst[1] == 0x33
+	if !ipv4 && !ipv6 { // 其它组播不过滤
+		return true
+	}
+	if dst == ipv4MulticastMAC(ipv4AllHosts) || dst == ipv6MulticastMAC(ipv6AllNodes) {
+		return true
+	}
+	dev.mcastMutex.Lock()
+	defer dev.mcastMutex.Unlock()
+	return dev.mcastMACs[dst] > 0
+}
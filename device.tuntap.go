@@ -7,16 +7,32 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"sync"
 	"syscall"
 	"unsafe"
 )
 
 type device struct {
 	io.ReadWriteCloser
+	name string
 	hardwareAddr [6]byte
-	ipv4Addr [4]byte
+	mtu int // 链路层能承载的最大 payload, 超过时 ip 层需要分片, 用 linkMTU 读取
+	mtu6 int // RA 通告的 ipv6 MTU, 0 表示与 mtu 相同
+	ipv4Addrs []*ipv4Address
+	ipv6Addrs []*ipv6Address
+	mutex sync.RWMutex // 保护 ipv4Addrs 和 ipv6Addrs, 地址会在运行时增删
+	sig chan struct{} // run 开始后才有值, 运行时新增的地址用它启动冲突检测
+	mcastMACs map[[6]byte]int // 接收的组播 mac 及其引用计数
+	igmp *igmpState
+	mld *mldState
+	master *vrf // 所属的 VRF, nil 表示 defaultVRF
+	raReceived bool // 是否收到过路由器通告, 收到后停止发送路由器请求
+	mcastMutex sync.Mutex // 保护 mcastMACs 以及 igmp 和 mld 的创建
 }
 
+// 所有打开的设备
+var devices []*device
+
 type tuntap uint16
 
 // IFF_NO_PI 表示不需要包信息
@@ -58,19 +74,98 @@ func (flags tuntap) open(name string, cidr string, ipv4Addr [4]byte) (*device, e
 	}
 	var hardwareAddr [6]byte
 	copy(hardwareAddr[:], ifr.union[:6])
+	mtu, err := getLinkMTU(name)
+	if err != nil {
+		log.Println(err)
+		mtu = maxPayloadSize
+	}
 
 	// 返回的文件描述字 fd 可以用来 read 和 write 该虚拟设备的以太网缓冲区
-	return &device{
+	dev := &device{
 		ReadWriteCloser: fd,
+		name: name,
 		hardwareAddr: hardwareAddr,
-		ipv4Addr: ipv4Addr,
-	}, nil
+		mtu: mtu,
+	}
+	if prefix, err := parseIPv4Prefix(cidr); err == nil && ipv4Addr != [4]byte{} {
+		dev.addIPv4(ipv4Addr, prefix.len) // 地址要先经过冲突检测才能使用
+	}
+	devices = append(devices, dev)
+	return dev, nil
+}
+
+func deviceByName(name string) *device {
+	for _, dev := range devices {
+		if dev.name == name {
+			return dev
+		}
+	}
+	return nil
 }
 
 func (flags tuntap) lazy(i int) (*device, error){
 	return flags.open("dev"+strconv.Itoa(i), fmt.Sprintf("10.%d.0.0/24", i),  [4]byte{10,byte(i),0,1})
 }
 
+// 设备 MTU 的范围, 上限由 run 的接收缓冲区决定
+const (
+	deviceMinMTU = 68 // ipv4 要求链路至少能承载 68 字节 (RFC 791)
+	deviceMaxMTU = 9000
+)
+
+// 通过 SIOCGIFMTU 读取网卡的 MTU, 这个 ioctl 要在 socket 上执行, tun 的 fd 不支持
+func getLinkMTU(name string) (int, error) {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(sock)
+	var ifr struct {
+		name	[0x10]byte
+		mtu	int32
+		pad	[0x28 - 0x10 - 4]byte
+	}
+	copy(ifr.name[:], name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sock), syscall.SIOCGIFMTU, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return 0, errno
+	}
+	mtu := int(ifr.mtu)
+	if mtu < deviceMinMTU || mtu > deviceMaxMTU {
+		return 0, fmt.Errorf("%s: unsupported mtu %d", name, mtu)
+	}
+	return mtu, nil
+}
+
+//SetLinkMTU 修改系统中网卡的 MTU, 使内核发来的帧不超过协议栈的 MTU
+func SetLinkMTU(name string, mtu int) (err error) {
+	//ip link set <device_name> mtu <mtu>
+	if out, err := exec.Command("ip", "link", "set", name, "mtu", strconv.Itoa(mtu)).CombinedOutput(); err != nil {
+		log.Println(string(out), err, name, mtu)
+		return err
+	}
+	return
+}
+
+func (dev *device) linkMTU() int {
+	dev.mutex.RLock()
+	defer dev.mutex.RUnlock()
+	return dev.mtu
+}
+
+// 修改协议栈使用的 MTU, RA 通告的 ipv6 MTU 超过新的链路 MTU 时作废
+func (dev *device) setMTU(mtu int) error {
+	if mtu < deviceMinMTU || mtu > deviceMaxMTU {
+		return fmt.Errorf("mtu must be between %d and %d", deviceMinMTU, deviceMaxMTU)
+	}
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	dev.mtu = mtu
+	if dev.mtu6 > mtu {
+		dev.mtu6 = 0
+	}
+	return nil
+}
+
 //SetLinkUp 让系统启动该网卡
 func SetLinkUp(name string) (err error) {
 	//ip link set <device_name> up
@@ -89,8 +184,23 @@ func SetRouter(name, cidr string) (err error) {
 }
 
 func (dev *device) run(sig chan struct{}, handler func(dev *device, frame *eth) error) {
-	fmt.Printf("start at %x %v\n", dev.hardwareAddr, dev.ipv4Addr)
-	buf := make([]byte, 2 << 12)
+	addrs := dev.ipv4Addresses()
+	fmt.Printf("start at %x %d addresses\n", dev.hardwareAddr, len(addrs))
+	dev.mutex.Lock()
+	dev.sig = sig
+	dev.mutex.Unlock()
+	dev.vrf().startAging(sig)
+	for _, a := range addrs {
+		go a.acd.run(sig)
+	}
+	if len(addrs) == 0 {
+		go dev.linkLocal(sig) // 没有配置地址时, 自动选择一个链路本地地址
+	}
+	dev.configureLinkLocal()
+	dev.startIPv6DAD(sig)
+	go dev.ageIPv6(sig)
+	go dev.solicitRouters(sig)
+	buf := make([]byte, headerSize + deviceMaxMTU + trailerSize)
 	var err error
 	var n int
 	var frame eth
@@ -110,6 +220,9 @@ func (dev *device) run(sig chan struct{}, handler func(dev *device, frame *eth)
 		if err = frame.decode(buf[:n]); err != nil {
 			break
 		}
+		if !dev.acceptFrame(frame.header.Dst) { // 没有加入的组播组
+			continue
+		}
 		if err = handler(dev, &frame); err == nil {
 			frame.header.Src = dev.hardwareAddr
 			dev.Write(frame.encode())
@@ -118,5 +231,15 @@ func (dev *device) run(sig chan struct{}, handler func(dev *device, frame *eth)
 	fmt.Println("good bye")
 }
 
+// 主动发送一个以太网帧, 用于不是对收到的帧做回复的场景
+func (dev *device) send(dst [6]byte, typ ethProtocolType, payload []byte) error {
+	frame := eth{payload: payload}
+	frame.header.Dst = dst
+	frame.header.Src = dev.hardwareAddr
+	frame.header.Type = typ
+	_, err := dev.Write(frame.encode())
+	return err
+}
+
 
 
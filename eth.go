@@ -22,6 +22,8 @@ const (
 	ethernetTypeIPv6 ethProtocolType = 0x86dd
 )
 
+var ethBroadcast = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
 type eth struct {
 	header struct {
 		Dst  [6]byte
@@ -0,0 +1,19 @@
+package main
+
+/*
+	ipv4 和 ipv6 的共同部分
+	传输层 (tcp, udp, icmpv6) 只通过 ipPacket 访问网络层, 这样同一份代码可以同时处理两个版本
+*/
+type ipPacket interface {
+	pseudoHeader(protocol uint8, length int) []byte // 传输层校验和使用的伪首部
+	upperPayload() []byte                           // 网络层首部 (以及扩展首部) 之后的数据
+	setUpperPayload(payload []byte)
+	swapAddresses() // 把收到的数据报改写为回复时交换源和目的地址
+}
+
+// 传输层的校验和: 伪首部加上传输层的数据
+func transportCheckSum(upper ipPacket, protocol uint8, segment []byte) uint16 {
+	pseudo := upper.pseudoHeader(protocol, len(segment))
+	b := append(pseudo, segment...)
+	return CheckSum16(b, len(b), 0)
+}
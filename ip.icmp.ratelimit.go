@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	icmp 差错报文的限速 (RFC 1812 4.3.2.8, RFC 4443 2.4 f)
+	差错报文由收到的数据报触发, 不限速的话很容易被用来放大流量或者扫描
+	和 Linux 一样使用两级令牌桶:
+	- 全局: 每秒最多 icmpRateGlobal 个, 允许 icmpBurstGlobal 的突发
+	- 每个目的地址: 每 icmpRatePeerInterval 一个, 允许 icmpBurstPeer 的突发
+	ipv4 和 ipv6 共用限速器, ipv4 地址按 ::ffff:a.b.c.d 的形式作为键
+*/
+const (
+	icmpRateGlobal       = 1000
+	icmpBurstGlobal      = 50
+	icmpRatePeerInterval = time.Second
+	icmpBurstPeer        = 6
+	icmpRatePeersMax     = 4096 // 记录的目的地址超过该值时, 清理已经回满的令牌桶, 清理后仍然超过则不再新建
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 按经过的时间补充令牌, 返回是否至少有一个令牌, 不取走令牌
+func (b *tokenBucket) refill(now time.Time, perSecond, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * perSecond
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	return b.tokens >= 1
+}
+
+type icmpPeerKey struct {
+	vrf  *vrf
+	addr [16]byte
+}
+
+type icmpRateLimiter struct {
+	global tokenBucket
+	peers  map[icmpPeerKey]*tokenBucket
+	pruned time.Time // 上次清理的时间, 令牌桶回满之前再次清理删不掉什么, 只会白白遍历
+	mutex  sync.Mutex
+}
+
+var icmpLimiter = &icmpRateLimiter{peers: make(map[icmpPeerKey]*tokenBucket)}
+
+func ipv4MappedIPv6(addr [4]byte) [16]byte {
+	return [16]byte{10: 0xff, 11: 0xff, 12: addr[0], 13: addr[1], 14: addr[2], 15: addr[3]}
+}
+
+// ipv4MappedIPv6 的逆运算, addr 不是映射地址时返回 false
+func ipv4Unmapped(addr [16]byte) ([4]byte, bool) {
+	var v4 [4]byte
+	if addr != ipv4MappedIPv6([4]byte{addr[12], addr[13], addr[14], addr[15]}) {
+		return v4, false
+	}
+	copy(v4[:], addr[12:])
+	return v4, true
+}
+
+// 是否允许向 dst 发送一个差错报文
+func (l *icmpRateLimiter) allow(v *vrf, dst [16]byte) bool {
+	now := time.Now()
+	peerRate := float64(time.Second) / float64(icmpRatePeerInterval)
+	key := icmpPeerKey{vrf: v, addr: dst}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	peer := l.peers[key]
+	if peer == nil {
+		if len(l.peers) >= icmpRatePeersMax {
+			l.pruneUnlocked(now, peerRate)
+		}
+		// 大量伪造的源地址让令牌桶都处于活跃状态, 此时拒绝新的目的地址, 避免表无限增长
+		if len(l.peers) >= icmpRatePeersMax {
+			return false
+		}
+		peer = &tokenBucket{}
+		l.peers[key] = peer
+	}
+	// 两个桶都有令牌时才各取走一个, 否则被全局限速拒绝的差错报文也会消耗目的地址的配额
+	peerOK := peer.refill(now, peerRate, icmpBurstPeer)
+	globalOK := l.global.refill(now, icmpRateGlobal, icmpBurstGlobal)
+	if !peerOK || !globalOK {
+		return false
+	}
+	peer.tokens--
+	l.global.tokens--
+	return true
+}
+
+// 删除令牌已经回满的目的地址, 它们与新建的令牌桶没有区别
+func (l *icmpRateLimiter) pruneUnlocked(now time.Time, peerRate float64) {
+	full := time.Duration(icmpBurstPeer / peerRate * float64(time.Second))
+	if now.Sub(l.pruned) < full {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.peers {
+		if now.Sub(b.last) >= full {
+			delete(l.peers, key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	路径 MTU 缓存, ipv4 和 ipv6 各用一个实例, 地址统一为 16 字节 (ipv4 使用映射地址)
+	路由器回复 Packet Too Big (ipv6) 或 fragmentation needed (ipv4) 时, 源端记下该目的地址的路径 MTU,
+	记录在 pathMTUTimeout 后过期, 重新使用链路 MTU 探测 (RFC 1191, RFC 8201)
+*/
+const pathMTUTimeout = 10 * time.Minute
+
+type pathMTUKey struct {
+	vrf *vrf
+	dst [16]byte
+}
+
+type pathMTUEntry struct {
+	mtu     int
+	expires time.Time
+}
+
+type pathMTUCache struct {
+	entries map[pathMTUKey]pathMTUEntry
+	floor   int // 路径 MTU 的下限, 差错报文中更小的值会被提高到它
+	mutex   sync.Mutex
+}
+
+func newPathMTUCache(floor int) *pathMTUCache {
+	return &pathMTUCache{entries: make(map[pathMTUKey]pathMTUEntry), floor: floor}
+}
+
+// 收到差错报文时调用, 只会降低路径 MTU
+func (c *pathMTUCache) update(v *vrf, dst [16]byte, mtu int) {
+	if mtu < c.floor {
+		mtu = c.floor
+	}
+	key := pathMTUKey{vrf: v, dst: dst}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if entry, ok := c.entries[key]; ok && time.Now().Before(entry.expires) && entry.mtu <= mtu {
+		return
+	}
+	c.entries[key] = pathMTUEntry{mtu: mtu, expires: time.Now().Add(pathMTUTimeout)}
+}
+
+// 发往 dst 的路径 MTU, 没有记录时返回 0
+func (c *pathMTUCache) lookup(v *vrf, dst [16]byte) int {
+	key := pathMTUKey{vrf: v, dst: dst}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return 0
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return 0
+	}
+	return entry.mtu
+}
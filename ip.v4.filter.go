@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+/*
+	入站数据报的源地址过滤, 用于不可信的网段
+	- martian: 不可能合法出现在网线上的地址, 总是丢弃
+	  源地址为 0.0.0.0/8 (除了 0.0.0.0 发往广播或组播, 即 DHCP 和 IGMP 的场景),
+	  127/8 (我们没有 loopback 设备), 组播地址, 广播地址, 或者是本机自己的地址
+	- 反向路径过滤 (RFC 3704), 用源地址查路由表:
+	  strict 要求回程路由的出口正好是收包的设备, loose 只要求存在回程路由
+	每种丢弃原因都有计数, 打开 logMartians 时每次丢弃都输出日志
+	过滤模式和计数按 VRF 隔离, 收包时使用收包设备所属 VRF 的设置
+*/
+type rpFilterMode uint8
+
+const (
+	rpFilterOff    rpFilterMode = iota
+	rpFilterStrict              // RFC 3704 strict reverse path
+	rpFilterLoose               // RFC 3704 loose reverse path
+)
+
+func (m rpFilterMode) String() string {
+	switch m {
+	case rpFilterStrict:
+		return "strict"
+	case rpFilterLoose:
+		return "loose"
+	}
+	return "off"
+}
+
+type martianReason uint8
+
+const (
+	martianNone martianReason = iota
+	martianZeroNet
+	martianLoopback
+	martianMulticastSource
+	martianBroadcastSource
+	martianLocalSource
+	martianReversePath
+	martianReasonMax
+)
+
+func (r martianReason) String() string {
+	switch r {
+	case martianZeroNet:
+		return "zeronet"
+	case martianLoopback:
+		return "loopback"
+	case martianMulticastSource:
+		return "multicast-source"
+	case martianBroadcastSource:
+		return "broadcast-source"
+	case martianLocalSource:
+		return "local-source"
+	case martianReversePath:
+		return "reverse-path"
+	}
+	return "none"
+}
+
+type ipv4SourceFilter struct {
+	rpFilter    rpFilterMode
+	logMartians bool
+	drops       [martianReasonMax]uint64
+	mutex       sync.Mutex
+}
+
+// 检查收到的数据报, 返回 martianNone 表示可以接收
+func (flt *ipv4SourceFilter) check(in *device, f *ipv4) martianReason {
+	reason := flt.classify(in, f)
+	if reason == martianNone {
+		return reason
+	}
+	flt.mutex.Lock()
+	flt.drops[reason]++
+	logging := flt.logMartians
+	flt.mutex.Unlock()
+	if logging {
+		log.Printf("martian source %v from %v on %s (%s)",
+			net.IP(f.header.Src[:]), net.IP(f.header.Dst[:]), in.name, reason)
+	}
+	return reason
+}
+
+func (flt *ipv4SourceFilter) classify(in *device, f *ipv4) martianReason {
+	src, dst := f.header.Src, f.header.Dst
+	switch {
+	case src == [4]byte{}:
+		// 还没有地址的主机 (DHCP 客户端, IGMP 报告) 可以用 0.0.0.0 发往广播或组播
+		if dst == ipv4LimitedBroadcast || ipv4IsMulticast(dst) {
+			return martianNone
+		}
+		return martianZeroNet
+	case src[0] == 0:
+		return martianZeroNet
+	case src[0] == 127 || dst[0] == 127:
+		return martianLoopback
+	case ipv4IsMulticast(src) || src[0] >= 240 && src != ipv4LimitedBroadcast:
+		return martianMulticastSource // 包括保留的 240/4
+	case src == ipv4LimitedBroadcast || in.isIPv4Broadcast(src):
+		return martianBroadcastSource
+	}
+	if in.vrf().ownsIPv4(src) {
+		return martianLocalSource
+	}
+	flt.mutex.Lock()
+	mode := flt.rpFilter
+	flt.mutex.Unlock()
+	if mode == rpFilterOff {
+		return martianNone
+	}
+	// 回程方向的查找, 源和目的互换
+	route, _ := in.vrf().rules.lookup(ipv4FlowKey{dst: src, src: dst, tos: f.header.TOS, mark: f.mark})
+	if route == nil || mode == rpFilterStrict && route.dev != in {
+		return martianReversePath
+	}
+	return martianNone
+}
+
+func (flt *ipv4SourceFilter) setRPFilter(mode rpFilterMode) {
+	flt.mutex.Lock()
+	defer flt.mutex.Unlock()
+	flt.rpFilter = mode
+}
+
+func (flt *ipv4SourceFilter) setLogMartians(on bool) {
+	flt.mutex.Lock()
+	defer flt.mutex.Unlock()
+	flt.logMartians = on
+}
+
+func (flt *ipv4SourceFilter) stats() (mode rpFilterMode, logging bool, drops [martianReasonMax]uint64) {
+	flt.mutex.Lock()
+	defer flt.mutex.Unlock()
+	return flt.rpFilter, flt.logMartians, flt.drops
+}
+
+func (flt *ipv4SourceFilter) resetStats() {
+	flt.mutex.Lock()
+	defer flt.mutex.Unlock()
+	flt.drops = [martianReasonMax]uint64{}
+}
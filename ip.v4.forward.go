@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+/*
+	ip 转发 (路由器模式), 目的地址不是自己的数据报:
+	1. TTL 减 1, 减到 0 时丢弃并回复 icmp time exceeded
+	2. 查路由表选择出口和下一跳, 没有路由时回复 icmp net unreachable
+	3. 处理 Record Route, Timestamp 以及源路由选项
+	4. 通过 ARP 解析下一跳的 mac 并发送, 首部校验和在 encode 时重新计算
+	   解析失败回复 icmp host unreachable, 超过出口 MTU 且设置了 DF 时回复 icmp fragmentation needed
+*/
+var ipv4Forwarding int32 // 由 ctl 协程修改, 收包时读取, 只能通过下面两个函数原子地访问
+
+func ipv4ForwardingEnabled() bool {
+	return atomic.LoadInt32(&ipv4Forwarding) != 0
+}
+
+func setIPv4Forwarding(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&ipv4Forwarding, v)
+}
+
+func forwardIPv4(in *device, f *ipv4) error {
+	options, _ := f.parseOptions()
+	sourceRoute := in.vrf().ownsIPv4(f.header.Dst) // 目的地址是自己, 只可能是源路由还没有走完
+	if !ipv4ForwardingEnabled() {
+		if sourceRoute {
+			in.sendIcmpError(f, icmpTypeDestUnreachable, icmpCodeSourceRouteFailed, 0)
+		}
+		return errors.New("Not us")
+	}
+	if !ipv4Forwardable(f) || in.isIPv4Broadcast(f.header.Dst) {
+		return errors.New("not forwardable")
+	}
+	if f.header.TTL <= 1 {
+		in.sendIcmpError(f, icmpTypeTimeExceeded, icmpCodeTTLExceeded, 0)
+		return errors.New("ttl exceeded")
+	}
+	dst := f.header.Dst
+	if sourceRoute {
+		dst, _ = findIPv4Option(options, ipv4OptionLSRR, ipv4OptionSSRR).nextHop()
+	}
+	key := ipv4FlowOf(f, in)
+	key.dst = dst
+	route, nextHop := in.vrf().rules.lookup(key) // 只在入口设备所在的 VRF 中转发
+	if route == nil {
+		in.sendIcmpError(f, icmpTypeDestUnreachable, icmpCodeNetUnreachable, 0)
+		return errors.New("no route to host")
+	}
+	out := route.dev.selectSourceIPv4(nextHop)
+	if sourceRoute {
+		if strict, _ := f.applySourceRoute(options, out); strict && route.gateway != [4]byte{} {
+			in.sendIcmpError(f, icmpTypeDestUnreachable, icmpCodeSourceRouteFailed, 0)
+			return errors.New("strict source route failed")
+		}
+	}
+	f.header.TTL--
+	if err := f.forwardOptions(options, out); err != nil {
+		if problem, ok := err.(*ipv4ParameterProblemError); ok {
+			in.sendIcmpError(f, icmpTypeParameterProblem, 0, uint32(problem.pointer)<<24)
+		}
+		return err
+	}
+	report := func(f *ipv4, err error) {
+		switch e := err.(type) {
+		case *fragmentationNeededError:
+			in.sendIcmpError(f, icmpTypeDestUnreachable, icmpCodeFragmentationNeeded, uint32(e.mtu))
+		default:
+			if err == errHostUnreachable {
+				in.sendIcmpError(f, icmpTypeDestUnreachable, icmpCodeHostUnreachable, 0)
+			}
+		}
+		log.Println(err)
+	}
+	if err := route.dev.outputIPv4(f, nextHop, report); err != nil {
+		report(f, err)
+		return err
+	}
+	return errors.New("forwarded")
+}
+
+// 广播, 组播以及链路本地地址 (RFC 3927) 的数据报不能转发
+func ipv4Forwardable(f *ipv4) bool {
+	for _, addr := range [][4]byte{f.header.Src, f.header.Dst} {
+		if addr[0] >= 224 || linkLocalPrefix.contains(addr) {
+			return false
+		}
+	}
+	return f.header.Src != [4]byte{}
+}
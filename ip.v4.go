@@ -12,13 +12,20 @@ import (
 type ipv4ProtocolType uint8
 const (
 	ipv4ProtocolTypeICMP ipv4ProtocolType = 0x01
+	ipv4ProtocolTypeIGMP ipv4ProtocolType = 0x02
 	ipv4ProtocolTypeTCP  ipv4ProtocolType = 0x06
 	ipv4ProtocolTypeUDP  ipv4ProtocolType = 0x11
 
 	ipv4Version = 4
+	ipv4DefaultTTL = 64
+)
+
+// Flags_FragmentOffset 字段中的标志位以及偏移的掩码
+const (
+	IPv4FlagMoreFragments = 1 << (13 + iota) // MF, 后面还有分片
+	IPv4FlagDontFragment                     // DF, 不允许分片
 
-	IPv4FlagMoreFragments = 1 << iota
-	IPv4FlagDontFragment
+	ipv4FragmentOffsetMask = 0x1fff // 偏移的单位是 8 字节
 )
 
 /*
@@ -62,7 +69,9 @@ type ipv4 struct {
 		Src                [4]byte
 		Dst                [4]byte
 	}
+	options []byte // 首部中固定 20 字节之后的部分
 	payload []byte
+	mark    uint32 // fwmark, 不在线路上传输, 只用于策略路由
 }
 
 func (f *ipv4) decode(data []byte) error {
@@ -80,59 +89,153 @@ func (f *ipv4) decode(data []byte) error {
 	if len(data) < hlen {
 		return fmt.Errorf("need least header length's data")
 	}
+	if hlen < 20 {
+		return &ipv4ParameterProblemError{pointer: 0, reason: "header length less than 20"}
+	}
+	// 校验和错误时首部的任何字段都不可信, 静默丢弃; 之后的首部错误回复 parameter problem
 	if sum := CheckSum16(data, hlen, 0); sum != 0 { // ip 校验和只需要校验头部
 		return fmt.Errorf("ip checksum error (%x)", sum)
 	}
-	if len(data) < int(f.header.Len) {
-		return fmt.Errorf("ip packet length error")
+	if len(data) < int(f.header.Len) { // 数据报在传输中被截断, 静默丢弃 (RFC 1812 5.2.2)
+		return fmt.Errorf("ip packet is truncated (%d < %d)", len(data), f.header.Len)
 	}
-	if f.header.TTL == 0 {
-		return fmt.Errorf("ip packet was dead (TTL=0)")
+	if int(f.header.Len) < hlen {
+		return &ipv4ParameterProblemError{pointer: 2, reason: "total length less than header length"}
 	}
+	// TTL 为 0 的数据报不在这里丢弃: 发给本机的照常接收 (RFC 1122 3.2.1.7), 需要转发的由 forwardIPv4 回复 time exceeded
+	f.options = data[20:hlen]
 	f.payload = data[hlen:int(f.header.Len)]
+	if _, err := f.parseOptions(); err != nil {
+		return err
+	}
 	return nil
 }
 
+// 首部长度和总长度根据 options 和 payload 重新计算, options 不足 4 字节的部分补 0
 func (f *ipv4) encode() []byte{
+	hlen := f.headerLen()
+	f.header.Version_IHL = ipv4Version<<4 | uint8(hlen>>2)
+	f.header.Len = uint16(hlen + len(f.payload))
 	f.header.Checksum = 0
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, &f.header)
+	buf.Write(f.options)
+	buf.Write(make([]byte, hlen-20-len(f.options)))
 	b := buf.Bytes()
-	binary.BigEndian.PutUint16(b[10:12], CheckSum16(b, int((f.header.Version_IHL&0x0f)<<2), 0))
+	binary.BigEndian.PutUint16(b[10:12], CheckSum16(b, hlen, 0))
 	return append(b, f.payload...)
 }
 
-/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
-  todo: ip数据报重组
-  当上层应用数据报过大,超过了MTU,那么在ip层就要进行拆包,将
-  大数据拆分成小数据发送出去,对方接收到之后也要进行组包.
- ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+func (f *ipv4) pseudoHeader(protocol uint8, length int) []byte {
+	b := make([]byte, 12)
+	copy(b[0:4], f.header.Src[:])
+	copy(b[4:8], f.header.Dst[:])
+	b[9] = protocol
+	binary.BigEndian.PutUint16(b[10:12], uint16(length))
+	return b
+}
+
+func (f *ipv4) upperPayload() []byte {
+	return f.payload
+}
+
+func (f *ipv4) setUpperPayload(payload []byte) {
+	f.payload = payload
+}
+
+func (f *ipv4) swapAddresses() {
+	f.header.Src, f.header.Dst = f.header.Dst, f.header.Src
+}
 
 func (f ipv4) handle(dev*device, upper *eth) (err error) {
 	if err = f.decode(upper.payload);err != nil{
 		log.Println(err)
+		// 首部可能有错, 引用收到的原始字节而不是重新 encode 的首部
+		if problem, ok := err.(*ipv4ParameterProblemError); ok && (dev.vrf().ownsIPv4(f.header.Dst) || ipv4ForwardingEnabled()) {
+			dev.sendIcmpErrorQuote(&f, icmpRawQuote(upper.payload), icmpTypeParameterProblem, 0, uint32(problem.pointer)<<24)
+		}
 		return
 	}
 	fmt.Printf("%s  ip %s src: %v dst: %v type: %d\n",
 		yellow, reset,
 		f.header.Src, f.header.Dst, f.header.Protocol)
 
-	if f.header.Dst != dev.ipv4Addr{
-		return errors.New("Not us")
+	if reason := dev.vrf().filter.check(dev, &f); reason != martianNone {
+		return errors.New("martian source: " + reason.String())
+	}
+	multicast := ipv4IsMulticast(f.header.Dst)
+	if multicast && !dev.inIPv4Group(f.header.Dst) {
+		return errors.New("not a member of the group")
+	}
+	broadcast := dev.isIPv4Broadcast(f.header.Dst)
+	if !multicast && !broadcast && !dev.vrf().ownsIPv4(f.header.Dst) { // 弱主机模型, 见 vrf.ownsIPv4
+		return forwardIPv4(dev, &f)
+	}
+	if f.header.Flags_FragmentOffset&(IPv4FlagMoreFragments|ipv4FragmentOffsetMask) != 0 {
+		whole, err := ipv4Fragments.add(dev, &f)
+		if whole == nil { // 分片还没收齐
+			return err
+		}
+		f = *whole
+	}
+	options, _ := f.parseOptions()
+	if opt := findIPv4Option(options, ipv4OptionLSRR, ipv4OptionSSRR); opt != nil && !broadcast && !multicast {
+		if _, more := opt.nextHop(); more { // 源路由还没有走完, 需要继续转发
+			return forwardIPv4(dev, &f)
+		}
 	}
 	switch f.header.Protocol {
 	case ipv4ProtocolTypeICMP:
-		err = (icmp{}).handle(&f)
+		if multicast { // 不回复发往组播地址的 echo
+			return errors.New("icmp to multicast address")
+		}
+		err = (icmp{}).handle(dev, &f)
+	case ipv4ProtocolTypeIGMP:
+		err = (igmp{}).handle(dev, &f)
 	case ipv4ProtocolTypeTCP:
-		err = (tcp{}).handle(&f)
+		if broadcast || multicast { // tcp 只接受单播 (RFC 1122 4.2.3.10)
+			return errors.New("tcp to broadcast address")
+		}
+		err = (tcp{}).handle(dev, &f)
+	case ipv4ProtocolTypeUDP:
+		err = (udp{}).handle(dev, &f)
 	default:
-		err = errors.New("TODO")
+		if !broadcast && !multicast {
+			dev.sendIcmpError(&f, icmpTypeDestUnreachable, icmpCodeProtocolUnreachable, 0)
+		}
+		return fmt.Errorf("unsupported protocol %d", f.header.Protocol)
 	}
 	if err == nil{
 		fmt.Printf("%s  ip+%s src: %v dst: %v type: %d\n",
 			yellow, reset,
 			f.header.Src, f.header.Dst, f.header.Protocol)
 
+		f.options = nil // 回复不携带请求中的选项
+		if broadcast { // 回复广播时, 源地址不能是广播地址
+			f.header.Src = dev.selectSourceIPv4(f.header.Dst)
+		}
+		// 回复是本机发出的新数据报, 不沿用请求的 TTL, Id 和分片标志
+		f.header.TTL = ipv4DefaultTTL
+		f.header.Flags_FragmentOffset = 0
+		f.assignId()
+		route, nextHop := dev.vrf().rules.lookup(ipv4FlowOf(&f, nil))
+		if route == nil {
+			return errors.New("no route to host")
+		}
+		if route.dev != dev || nextHop != f.header.Dst {
+			// 回复不是直接从收包的设备发回给对方, 走正常的发送流程
+			if err = dev.vrf().sendIPv4(&f); err == nil {
+				err = errors.New("sent by route")
+			}
+			return
+		}
+		if f.headerLen()+len(f.payload) > dev.pathMTU(f.header.Dst) {
+			// 回复超过了 MTU (比如回复一个重组后的大 ping), 分片后直接发出
+			if err = dev.transmitIPv4(&f, upper.header.Src); err == nil {
+				err = errors.New("sent as fragments")
+			}
+			return
+		}
 		upper.payload = f.encode()
 		upper.header.Dst = upper.header.Src
 	}
@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 )
 
 type icmp_echo struct {
@@ -35,12 +34,8 @@ func (f *icmp_echo) decode(data []byte) error{
 	return nil
 }
 
+// 回复 echo 请求, echo reply 由 pings 处理
 func (f icmp_echo) handle(upper *icmp) error{
-	switch upper.header.Type {
-	case icmpTypeEchoReply:
-		return errors.New("do nothing")
-	case icmpTypeEcho:
-	}
 	if err := f.decode(upper.payload);err != nil{
 		return err
 	}
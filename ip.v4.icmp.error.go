@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	icmpCodeNetUnreachable      = 0 // 目标不可达: 没有到达目的网络的路由
+	icmpCodeHostUnreachable     = 1 // 目标不可达: 目的主机没有响应 ARP
+	icmpCodeProtocolUnreachable = 2 // 目标不可达: 本机不支持该上层协议
+	icmpCodePortUnreachable     = 3 // 目标不可达: udp 端口没有 socket
+	icmpCodeFragmentationNeeded = 4 // 目标不可达: 需要分片但设置了 DF, rest 的低 16 位是下一跳的 MTU
+	icmpCodeSourceRouteFailed   = 5 // 目标不可达: 源路由失败
+
+	icmpCodeTTLExceeded        = 0 // 传输过程中 TTL 超时
+	icmpCodeReassemblyExceeded = 1 // 分片重组超时
+)
+
+/*
+	icmp 差错报文的格式
+
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|     Type      |     Code      |          Checksum             |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|             unused / pointer / next-hop MTU                   |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|      Internet Header + 64 bits of Original Data Datagram      |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+
+func isIcmpErrorType(t icmpType) bool {
+	switch t {
+	case icmpTypeDestUnreachable, icmpTypeTimeExceeded, icmpTypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// RFC 1122 3.2.2 规定了不能回复 icmp 差错报文的情况, 避免差错报文引发差错报文风暴
+func icmpErrorAllowed(original *ipv4) bool {
+	if original.header.Protocol == ipv4ProtocolTypeICMP &&
+		len(original.payload) > 0 && isIcmpErrorType(icmpType(original.payload[0])) {
+		return false
+	}
+	if original.header.Flags_FragmentOffset&ipv4FragmentOffsetMask != 0 { // 只对第一个分片回复
+		return false
+	}
+	for _, addr := range [][4]byte{original.header.Src, original.header.Dst} {
+		if addr[0] >= 224 || addr == [4]byte{255, 255, 255, 255} { // 组播或广播
+			return false
+		}
+	}
+	src := original.header.Src
+	return src != [4]byte{} && src[0] != 127
+}
+
+// 引用原始数据报的首部以及数据的前 8 个字节
+func icmpQuote(original *ipv4) []byte {
+	hlen := original.headerLen()
+	n := len(original.payload)
+	if n > 8 {
+		n = 8
+	}
+	return original.encode()[:hlen+n]
+}
+
+// 收到的首部长度字段, 小于 20 时按 20 处理
+func icmpQuoteHeaderLen(data []byte) int {
+	hlen := int(data[0]&0x0f) << 2
+	if hlen < 20 {
+		hlen = 20
+	}
+	return hlen
+}
+
+// 首部有错时直接引用收到的原始字节, 重新 encode 会修正出错的字段
+func icmpRawQuote(data []byte) []byte {
+	n := icmpQuoteHeaderLen(data) + 8
+	if n > len(data) {
+		n = len(data)
+	}
+	return append([]byte(nil), data[:n]...)
+}
+
+/*
+	针对 original 向其源地址发送一个 icmp 差错报文, rest 是 icmp 首部之后的 4 个字节
+	差错报文按目的地址限速, 超过速率时丢弃
+*/
+func (dev *device) sendIcmpError(original *ipv4, typ icmpType, code uint8, rest uint32) error {
+	return dev.sendIcmpErrorQuote(original, nil, typ, code, rest)
+}
+
+// 同 sendIcmpError, quote 不为 nil 时用它作为引用的内容
+func (dev *device) sendIcmpErrorQuote(original *ipv4, quote []byte, typ icmpType, code uint8, rest uint32) error {
+	if !icmpErrorAllowed(original) {
+		return errors.New("icmp error not allowed")
+	}
+	if !icmpLimiter.allow(dev.vrf(), ipv4MappedIPv6(original.header.Src)) {
+		return errors.New("icmp error rate limited")
+	}
+	src := dev.selectSourceIPv4(original.header.Src)
+	if src == [4]byte{} {
+		return errors.New("no usable address")
+	}
+	if quote == nil {
+		quote = icmpQuote(original)
+	}
+	var msg icmp
+	msg.header.Type = typ
+	msg.header.Code = code
+	msg.payload = make([]byte, 4+len(quote))
+	binary.BigEndian.PutUint32(msg.payload[:4], rest)
+	copy(msg.payload[4:], quote)
+
+	return dev.vrf().ipv4Output(src, original.header.Src, ipv4ProtocolTypeICMP, msg.encode(), 0, 0)
+}
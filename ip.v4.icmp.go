@@ -11,8 +11,11 @@ import (
 type icmpType uint8
 
 const (
-	icmpTypeEchoReply icmpType = 0
-	icmpTypeEcho      icmpType = 8
+	icmpTypeEchoReply        icmpType = 0
+	icmpTypeDestUnreachable  icmpType = 3
+	icmpTypeEcho             icmpType = 8
+	icmpTypeTimeExceeded     icmpType = 11
+	icmpTypeParameterProblem icmpType = 12
 )
 
 type icmp struct {
@@ -51,13 +54,17 @@ func (f *icmp) encode() []byte{
 	return buf
 }
 
-func (f icmp) handle(upper *ipv4) (err error){
+func (f icmp) handle(dev *device, upper *ipv4) (err error){
 	if err = f.decode(upper.payload);err != nil{
 		return err
 	}
 	switch f.header.Type {
-		case icmpTypeEcho, icmpTypeEchoReply:
+		case icmpTypeEcho:
 			err = (icmp_echo{}).handle(&f)
+		case icmpTypeEchoReply:
+			err = pings.input(dev, upper, &f)
+		case icmpTypeDestUnreachable, icmpTypeTimeExceeded, icmpTypeParameterProblem:
+			err = dev.handleIcmpError(upper, &f)
 		default:
 			err = errors.New("TODO")
 	}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	errNetUnreachable      = errors.New("network unreachable")
+	errProtocolUnreachable = errors.New("protocol not available")
+	errConnectionRefused   = errors.New("connection refused")
+	errMessageTooLong      = errors.New("message too long")
+	errSourceRouteFailed   = errors.New("source route failed")
+	errTimeExceeded        = errors.New("time exceeded")
+	errParameterProblem    = errors.New("parameter problem")
+)
+
+/*
+	收到的 icmp 差错报文, 根据引用的原始数据报交给发出它的 tcp 连接, udp socket 或 ping
+	RFC 1122 4.2.3.9 把差错分成两类:
+	- 硬错误: 协议不可达, 端口不可达, tcp 收到后中止连接
+	- 软错误: 其余的目标不可达, TTL 超时, parameter problem, 只记录下来, 连接超时关闭时再报告给应用
+	需要分片的差错按 RFC 1191 更新路径 MTU, 不再当作硬错误
+*/
+type icmpError struct {
+	from    [4]byte // 发出差错报文的节点
+	dst     [4]byte // 原数据报的目的地址和端口
+	dstPort uint16  // 不是 tcp 和 udp 时为 0
+	typ     icmpType
+	code    uint8
+	mtu     int // 需要分片时更新后的路径 MTU
+	err     error
+}
+
+func (e *icmpError) Error() string {
+	dst := net.IP(e.dst[:]).String()
+	if e.dstPort != 0 {
+		dst = fmt.Sprintf("%s:%d", dst, e.dstPort)
+	}
+	if e.mtu != 0 {
+		return fmt.Sprintf("%s: %v (path mtu %d, from %v)", dst, e.err, e.mtu, net.IP(e.from[:]))
+	}
+	return fmt.Sprintf("%s: %v (from %v)", dst, e.err, net.IP(e.from[:]))
+}
+
+// 使调用者可以用 errors.Is(err, errConnectionRefused) 判断原因
+func (e *icmpError) Unwrap() error {
+	return e.err
+}
+
+func (e *icmpError) hard() bool {
+	return e.typ == icmpTypeDestUnreachable &&
+		(e.code == icmpCodeProtocolUnreachable || e.code == icmpCodePortUnreachable)
+}
+
+func (e *icmpError) fragmentationNeeded() bool {
+	return e.typ == icmpTypeDestUnreachable && e.code == icmpCodeFragmentationNeeded
+}
+
+func icmpErrorCause(typ icmpType, code uint8) error {
+	switch typ {
+	case icmpTypeDestUnreachable:
+		switch code {
+		case icmpCodeNetUnreachable:
+			return errNetUnreachable
+		case icmpCodeProtocolUnreachable:
+			return errProtocolUnreachable
+		case icmpCodePortUnreachable:
+			return errConnectionRefused
+		case icmpCodeFragmentationNeeded:
+			return errMessageTooLong
+		case icmpCodeSourceRouteFailed:
+			return errSourceRouteFailed
+		}
+		return errHostUnreachable // 其余的 code 都按主机不可达处理
+	case icmpTypeTimeExceeded:
+		return errTimeExceeded
+	}
+	return errParameterProblem
+}
+
+// 解析差错报文引用的原始数据报, 至少要有完整的 ip 首部和传输层的前 8 个字节 (端口以及 tcp 的序列号)
+func parseIcmpQuote(data []byte) (*ipv4, error) {
+	var inner ipv4
+	if len(data) < 20 {
+		return nil, errors.New("icmp quote is too short")
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &inner.header); err != nil {
+		return nil, err
+	}
+	if inner.header.Version_IHL>>4 != ipv4Version {
+		return nil, errors.New("icmp quote is not ipv4")
+	}
+	hlen := int(inner.header.Version_IHL&0x0f) << 2
+	if hlen < 20 || len(data) < hlen+8 {
+		return nil, errors.New("icmp quote is too short")
+	}
+	inner.options = data[20:hlen]
+	inner.payload = data[hlen:]
+	return &inner, nil
+}
+
+// 常见链路 MTU 的平台值 (RFC 1191 7)
+var ipv4MTUPlateaus = []int{32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, 68}
+
+// 需要分片的差错中下一跳的 MTU, 旧的路由器不填写该字段, 这时取比原数据报总长度小的平台值
+func ipv4NextHopMTU(rest uint32, inner *ipv4) int {
+	if mtu := int(rest & 0xffff); mtu != 0 {
+		return mtu
+	}
+	for _, mtu := range ipv4MTUPlateaus {
+		if mtu < int(inner.header.Len) {
+			return mtu
+		}
+	}
+	return ipv4MTUPlateaus[len(ipv4MTUPlateaus)-1]
+}
+
+/*
+	处理收到的目标不可达, 超时和 parameter problem
+	原数据报是本机发出的, 所以引用的源地址和端口是本地的, 目的地址和端口是对端的
+	只有第一个分片带有传输层首部, 对其它分片的差错只更新路径 MTU
+*/
+func (dev *device) handleIcmpError(upper *ipv4, f *icmp) error {
+	if len(f.payload) < 4 {
+		return errors.New("invalid icmp error")
+	}
+	rest := binary.BigEndian.Uint32(f.payload[:4])
+	inner, err := parseIcmpQuote(f.payload[4:])
+	if err != nil {
+		return err
+	}
+	e := &icmpError{
+		from: upper.header.Src,
+		dst:  inner.header.Dst,
+		typ:  f.header.Type,
+		code: f.header.Code,
+		err:  icmpErrorCause(f.header.Type, f.header.Code),
+	}
+	if inner.header.Protocol == ipv4ProtocolTypeTCP || inner.header.Protocol == ipv4ProtocolTypeUDP {
+		e.dstPort = binary.BigEndian.Uint16(inner.payload[2:4])
+	}
+	v := dev.vrf()
+	if e.fragmentationNeeded() {
+		dst := ipv4MappedIPv6(inner.header.Dst)
+		ipv4PathMTUs.update(v, dst, ipv4NextHopMTU(rest, inner))
+		e.mtu = ipv4PathMTUs.lookup(v, dst)
+	}
+	fmt.Printf("%s icmp%s %v\n", blue, reset, e)
+	if inner.header.Flags_FragmentOffset&ipv4FragmentOffsetMask != 0 {
+		return errors.New("do nothing")
+	}
+	srcPort := binary.BigEndian.Uint16(inner.payload[0:2])
+	delivered := false
+	switch inner.header.Protocol {
+	case ipv4ProtocolTypeICMP:
+		delivered = pings.notify(v, inner, e)
+	case ipv4ProtocolTypeTCP:
+		delivered = v.tcp.notify(inner.header.Src, srcPort, binary.BigEndian.Uint32(inner.payload[4:8]), e)
+	case ipv4ProtocolTypeUDP:
+		delivered = v.udp.notify(inner.header.Src, srcPort, e)
+	}
+	if !delivered {
+		return errors.New("icmp error for no socket")
+	}
+	return errors.New("do nothing")
+}
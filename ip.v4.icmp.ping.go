@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	icmp echo 客户端
+	每次 ping 占用一个 identifier, 请求的 sequence 从 1 开始递增,
+	数据部分的前 8 个字节是发送时的时间戳 (纳秒), 之后用递增的字节填充到 size
+	回复按 identifier 找到发出请求的 ping, size 小于 8 时用记录的发送时间计算往返时间
+*/
+const (
+	pingDefaultSize = 56
+	pingMaxSize     = 65507           // 65535 - 20 (ip 首部) - 8 (icmp 首部)
+	pingTimeout     = 2 * time.Second // 最后一个请求发出后等待回复的时间
+)
+
+// 一个请求的结果, err 不为 nil 时是路径上返回的 icmp 差错, sendErr 不为 nil 时请求没有发出
+type pingReply struct {
+	from    [4]byte
+	seq     uint16
+	ttl     uint8
+	size    int // 回复中 icmp 报文的长度
+	rtt     time.Duration
+	dup     bool
+	err     *icmpError
+	sendErr error
+}
+
+type pingSession struct {
+	vrf     *vrf
+	dst     [4]byte
+	id      uint16
+	sent    map[uint16]time.Time
+	replies chan pingReply
+}
+
+type pingTable struct {
+	sessions map[uint16]*pingSession
+	nextId   uint16
+	mutex    sync.Mutex
+}
+
+var pings = &pingTable{sessions: make(map[uint16]*pingSession), nextId: uint16(rand.Uint32())}
+
+// 分配一个没有被占用的 identifier
+func (t *pingTable) open(v *vrf, dst [4]byte, count int) (*pingSession, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.sessions) > 0xffff {
+		return nil, errors.New("too many pings")
+	}
+	for {
+		t.nextId++
+		if _, ok := t.sessions[t.nextId]; !ok {
+			break
+		}
+	}
+	s := &pingSession{
+		vrf:     v,
+		dst:     dst,
+		id:      t.nextId,
+		sent:    make(map[uint16]time.Time),
+		replies: make(chan pingReply, count),
+	}
+	t.sessions[s.id] = s
+	return s, nil
+}
+
+func (t *pingTable) close(s *pingSession) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.sessions, s.id)
+}
+
+// 找到请求 (id, seq) 所属的 ping, 返回发送时间
+func (t *pingTable) lookup(v *vrf, id, seq uint16) (*pingSession, time.Time, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s, ok := t.sessions[id]
+	if !ok || s.vrf != v {
+		return nil, time.Time{}, false
+	}
+	sent, ok := s.sent[seq]
+	return s, sent, ok
+}
+
+func (s *pingSession) send(seq uint16, size int) error {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	now := time.Now()
+	if size >= 8 {
+		binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+	}
+	pings.mutex.Lock()
+	s.sent[seq] = now
+	pings.mutex.Unlock()
+	echo := icmp_echo{id: s.id, seq: seq, payload: payload}
+	var msg icmp
+	msg.header.Type = icmpTypeEcho
+	msg.payload = echo.encode()
+	var ttl uint8
+	if ipv4IsMulticast(s.dst) {
+		ttl = 1 // 与 ping 命令相同, 组播默认只发往本地链路
+	}
+	return s.vrf.ipv4Output([4]byte{}, s.dst, ipv4ProtocolTypeICMP, msg.encode(), 0, ttl)
+}
+
+func (s *pingSession) deliver(r pingReply) {
+	select {
+	case s.replies <- r:
+	default: // 重复的回复太多, 丢弃
+	}
+}
+
+/*
+	收到 echo reply 时调用, 回复由 ping 处理, 不需要协议栈应答
+	发往单播地址的请求只接受该地址的回复, 广播和组播则接受任意地址的回复
+*/
+func (t *pingTable) input(dev *device, upper *ipv4, f *icmp) error {
+	var echo icmp_echo
+	if err := echo.decode(f.payload); err != nil {
+		return err
+	}
+	s, sent, ok := t.lookup(dev.vrf(), echo.id, echo.seq)
+	if !ok {
+		return errors.New("echo reply for no ping")
+	}
+	if upper.header.Src != s.dst && !ipv4IsMulticast(s.dst) && !dev.isIPv4Broadcast(s.dst) {
+		return errors.New("echo reply from another host")
+	}
+	now := time.Now()
+	if len(echo.payload) >= 8 {
+		sent = time.Unix(0, int64(binary.BigEndian.Uint64(echo.payload)))
+	}
+	s.deliver(pingReply{
+		from: upper.header.Src,
+		seq:  echo.seq,
+		ttl:  upper.header.TTL,
+		size: 4 + len(f.payload),
+		rtt:  now.Sub(sent),
+	})
+	return errors.New("do nothing")
+}
+
+// 引用的原始数据报是某个 ping 发出的 echo 请求时, 把差错交给它
+func (t *pingTable) notify(v *vrf, inner *ipv4, e *icmpError) bool {
+	if icmpType(inner.payload[0]) != icmpTypeEcho {
+		return false
+	}
+	id := binary.BigEndian.Uint16(inner.payload[4:6])
+	seq := binary.BigEndian.Uint16(inner.payload[6:8])
+	s, _, ok := t.lookup(v, id, seq)
+	if !ok {
+		return false
+	}
+	s.deliver(pingReply{from: e.from, seq: seq, err: e})
+	return true
+}
+
+type pingStats struct {
+	dst         [4]byte
+	size        int
+	transmitted int
+	received    int // 不包括重复的回复
+	duplicates  int
+	errors      int
+	failed      int // 没有发出的请求, 计入丢包
+	min, max    time.Duration
+	avg, mdev   time.Duration
+	replies     []pingReply // 按收到的顺序
+	sum, sum2   float64     // 往返时间的和以及平方和, 用于计算 avg 和 mdev
+}
+
+func (st *pingStats) add(r pingReply, seen map[uint16]bool) {
+	if r.sendErr != nil {
+		st.failed++
+		st.replies = append(st.replies, r)
+		return
+	}
+	if r.err != nil {
+		st.errors++
+		st.replies = append(st.replies, r)
+		return
+	}
+	if r.dup = seen[r.seq]; r.dup {
+		st.duplicates++
+	} else {
+		seen[r.seq] = true
+		st.received++
+		if st.received == 1 || r.rtt < st.min {
+			st.min = r.rtt
+		}
+		if r.rtt > st.max {
+			st.max = r.rtt
+		}
+		st.sum += float64(r.rtt)
+		st.sum2 += float64(r.rtt) * float64(r.rtt)
+	}
+	st.replies = append(st.replies, r)
+}
+
+// mdev 是往返时间的标准差, 与 iputils 的 ping 相同
+func (st *pingStats) finish() {
+	if st.received == 0 {
+		return
+	}
+	n := float64(st.received)
+	mean := st.sum / n
+	st.avg = time.Duration(mean)
+	st.mdev = time.Duration(math.Sqrt(math.Max(st.sum2/n-mean*mean, 0)))
+}
+
+// 丢包率, 百分比
+func (st *pingStats) loss() float64 {
+	if st.transmitted == 0 {
+		return 0
+	}
+	return float64(st.transmitted-st.received) * 100 / float64(st.transmitted)
+}
+
+func msString(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+// 与 ping 命令的输出格式相同
+func (st *pingStats) String() string {
+	var b strings.Builder
+	dst := net.IP(st.dst[:])
+	fmt.Fprintf(&b, "PING %v %d(%d) bytes of data.\n", dst, st.size, st.size+28)
+	for _, r := range st.replies {
+		if r.sendErr != nil {
+			fmt.Fprintf(&b, "ping: icmp_seq=%d: %v\n", r.seq, r.sendErr)
+			continue
+		}
+		if r.err != nil {
+			fmt.Fprintf(&b, "From %v icmp_seq=%d %v\n", net.IP(r.from[:]), r.seq, r.err.err)
+			continue
+		}
+		fmt.Fprintf(&b, "%d bytes from %v: icmp_seq=%d ttl=%d time=%s ms", r.size, net.IP(r.from[:]), r.seq, r.ttl, msString(r.rtt))
+		if r.dup {
+			b.WriteString(" (DUP!)")
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\n--- %v ping statistics ---\n", dst)
+	fmt.Fprintf(&b, "%d packets transmitted, %d received", st.transmitted, st.received)
+	if st.duplicates > 0 {
+		fmt.Fprintf(&b, ", +%d duplicates", st.duplicates)
+	}
+	if st.errors > 0 {
+		fmt.Fprintf(&b, ", +%d errors", st.errors)
+	}
+	fmt.Fprintf(&b, ", %g%% packet loss\n", math.Round(st.loss()*1000)/1000)
+	if st.received > 0 {
+		fmt.Fprintf(&b, "rtt min/avg/max/mdev = %s/%s/%s/%s ms\n", msString(st.min), msString(st.avg), msString(st.max), msString(st.mdev))
+	}
+	return b.String()
+}
+
+/*
+	在 VRF v 中向 dst 发送 count 个数据部分为 size 字节的 echo 请求, 相邻请求间隔 interval
+	所有请求都有了结果, 或者最后一个请求发出 pingTimeout 之后返回统计结果
+	与 ping 命令相同, 发送失败 (如暂时没有路由) 的请求记为丢失, 继续发送后面的请求
+*/
+func (v *vrf) ping(dst [4]byte, count, size int, interval time.Duration) (*pingStats, error) {
+	if count <= 0 || count > 0xffff {
+		return nil, errors.New("invalid count")
+	}
+	if size < 0 || size > pingMaxSize {
+		return nil, errors.New("invalid size")
+	}
+	if interval <= 0 {
+		return nil, errors.New("invalid interval")
+	}
+	s, err := pings.open(v, dst, count)
+	if err != nil {
+		return nil, err
+	}
+	defer pings.close(s)
+
+	st := &pingStats{dst: dst, size: size}
+	seen := make(map[uint16]bool)
+	next := time.After(0)
+	var timeout <-chan time.Time
+	for st.transmitted < count || st.received+st.errors+st.failed < count {
+		select {
+		case <-next:
+			st.transmitted++
+			if err = s.send(uint16(st.transmitted), size); err != nil {
+				st.add(pingReply{seq: uint16(st.transmitted), sendErr: err}, seen)
+			}
+			if st.transmitted < count {
+				next = time.After(interval)
+			} else {
+				next, timeout = nil, time.After(pingTimeout)
+			}
+		case r := <-s.replies:
+			st.add(r, seen)
+		case <-timeout:
+			st.finish()
+			return st, nil
+		}
+	}
+	st.finish()
+	return st, nil
+}
+
+// 在 defaultVRF 中 ping
+func Ping(dst [4]byte, count, size int, interval time.Duration) (*pingStats, error) {
+	return defaultVRF.ping(dst, count, size, interval)
+}
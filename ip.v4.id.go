@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+/*
+	Identification 字段的生成
+	同一个 (源, 目的, 协议) 在重组超时内不能重复使用 Id, 否则分片会被错误地拼在一起
+	全局只用一个计数器的话, 对方可以通过 Id 推算出我们发给其它主机的流量, 所以按目的分开计数
+	和 Linux 一样用固定数量的桶, 目的地址等经过带随机密钥的哈希映射到桶, 桶的初始值也是随机的
+*/
+const ipv4IdentBuckets = 2048
+
+type ipv4IdentGenerator struct {
+	secret uint32
+	idents [ipv4IdentBuckets]uint32
+}
+
+var ipv4Idents = newIPv4IdentGenerator()
+
+func newIPv4IdentGenerator() *ipv4IdentGenerator {
+	g := &ipv4IdentGenerator{secret: rand.Uint32()}
+	for i := range g.idents {
+		g.idents[i] = rand.Uint32()
+	}
+	return g
+}
+
+func (g *ipv4IdentGenerator) next(src, dst [4]byte, protocol ipv4ProtocolType) uint16 {
+	var key [13]byte
+	binary.BigEndian.PutUint32(key[:4], g.secret)
+	copy(key[4:8], src[:])
+	copy(key[8:12], dst[:])
+	key[12] = byte(protocol)
+	h := fnv.New32a()
+	h.Write(key[:])
+	return uint16(atomic.AddUint32(&g.idents[h.Sum32()%ipv4IdentBuckets], 1))
+}
+
+// 为本机发出的数据报分配 Id
+func (f *ipv4) assignId() {
+	f.header.Id = ipv4Idents.next(f.header.Src, f.header.Dst, f.header.Protocol)
+}
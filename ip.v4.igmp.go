@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	IGMP, 主机通过它告诉本地路由器自己加入了哪些组播组
+
+	v1/v2 报文:
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|      Type     | Max Resp Time |           Checksum            |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|                         Group Address                         |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	v3 查询在此之后还有 Resv|S|QRV, QQIC, 源地址个数和源地址列表
+	v3 报告的第二个 32 位是 Reserved + 组记录个数, 之后是若干组记录:
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|  Record Type  |  Aux Data Len |     Number of Sources (N)     |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|                       Multicast Address                       |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	默认使用 v3, 收到 v1/v2 的查询后, 在 igmpOlderQuerierTimeout 内切换到对应的版本
+	这里只支持任意源组播, 即加入时报告 EXCLUDE {}, 离开时报告 INCLUDE {}
+*/
+const (
+	igmpTypeQuery    = 0x11
+	igmpTypeV1Report = 0x12
+	igmpTypeV2Report = 0x16
+	igmpTypeLeave    = 0x17
+	igmpTypeV3Report = 0x22
+
+	igmpModeIsExclude       = 2 // 回应查询: 当前状态为 EXCLUDE
+	igmpChangeToInclude     = 3 // 状态变化: 离开组
+	igmpChangeToExclude     = 4 // 状态变化: 加入组
+	igmpRobustness          = 2
+	igmpUnsolicitedDelay    = time.Second
+	igmpOlderQuerierTimeout = igmpRobustness*125*time.Second + 10*time.Second
+)
+
+var (
+	ipv4AllHosts      = [4]byte{224, 0, 0, 1}
+	ipv4AllRouters    = [4]byte{224, 0, 0, 2}
+	ipv4IGMPv3Routers = [4]byte{224, 0, 0, 22}
+)
+
+type igmp struct {
+	header struct {
+		Type     uint8
+		MaxResp  uint8
+		Checksum uint16
+		Group    [4]byte
+	}
+	payload []byte
+}
+
+func (f *igmp) decode(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("igmp message is too short")
+	}
+	if sum := CheckSum16(data, len(data), 0); sum != 0 {
+		return fmt.Errorf("igmp checksum error (%x)", sum)
+	}
+	buf := bytes.NewBuffer(data)
+	if err := binary.Read(buf, binary.BigEndian, &f.header); err != nil {
+		return err
+	}
+	f.payload = buf.Bytes()
+	return nil
+}
+
+func (f *igmp) encode() []byte {
+	f.header.Checksum = 0
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &f.header)
+	buf.Write(f.payload)
+	b := buf.Bytes()
+	binary.BigEndian.PutUint16(b[2:4], CheckSum16(b, len(b), 0))
+	return b
+}
+
+type igmpGroup struct {
+	addr        [4]byte
+	users       int           // 加入该组的次数
+	timer       *time.Timer   // 待发送的报告
+	unsolicited []*time.Timer // 加入时待发送的主动报告, 离开时停止
+	deadline    time.Time
+}
+
+type igmpState struct {
+	groups  map[[4]byte]*igmpGroup
+	v1Until time.Time   // 存在 v1 查询者
+	v2Until time.Time   // 存在 v2 查询者
+	general *time.Timer // v3 对通用查询的汇总报告
+	mutex   sync.Mutex
+}
+
+func (dev *device) igmpState() *igmpState {
+	dev.mcastMutex.Lock()
+	defer dev.mcastMutex.Unlock()
+	if dev.igmp == nil {
+		dev.igmp = &igmpState{groups: make(map[[4]byte]*igmpGroup)}
+	}
+	return dev.igmp
+}
+
+func (st *igmpState) versionUnlocked() int {
+	now := time.Now()
+	if now.Before(st.v1Until) {
+		return 1
+	}
+	if now.Before(st.v2Until) {
+		return 2
+	}
+	return 3
+}
+
+// 设备是否加入了组播组, 所有主机组 224.0.0.1 总是加入的
+func (dev *device) inIPv4Group(group [4]byte) bool {
+	if group == ipv4AllHosts {
+		return true
+	}
+	st := dev.igmpState()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.groups[group] != nil
+}
+
+func (dev *device) joinIPv4Group(group [4]byte) error {
+	if group == ipv4AllHosts {
+		return nil
+	}
+	st := dev.igmpState()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if g := st.groups[group]; g != nil {
+		g.users++
+		return nil
+	}
+	g := &igmpGroup{addr: group, users: 1}
+	st.groups[group] = g
+	dev.addMulticastMAC(ipv4MulticastMAC(group))
+	fmt.Printf("%sigmp %s %s join %v\n", magenta, reset, dev.name, net.IP(group[:]))
+	// 主动发送报告, 发送 igmpRobustness 次以防丢失, 发送前已经离开 (或者离开后又重新加入) 时不再发送
+	version := st.versionUnlocked()
+	for i := 0; i < igmpRobustness; i++ {
+		g.unsolicited = append(g.unsolicited, time.AfterFunc(time.Duration(i)*igmpUnsolicitedDelay, func() {
+			st.mutex.Lock()
+			member := st.groups[group] == g
+			st.mutex.Unlock()
+			if member {
+				dev.sendIGMPReport(version, group, igmpChangeToExclude)
+			}
+		}))
+	}
+	return nil
+}
+
+func (dev *device) leaveIPv4Group(group [4]byte) error {
+	if group == ipv4AllHosts {
+		return nil
+	}
+	st := dev.igmpState()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	g := st.groups[group]
+	if g == nil {
+		return errors.New("not a member")
+	}
+	if g.users--; g.users > 0 {
+		return nil
+	}
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	for _, t := range g.unsolicited {
+		t.Stop()
+	}
+	delete(st.groups, group)
+	dev.delMulticastMAC(ipv4MulticastMAC(group))
+	fmt.Printf("%sigmp %s %s leave %v\n", magenta, reset, dev.name, net.IP(group[:]))
+	switch version := st.versionUnlocked(); version {
+	case 2:
+		dev.sendIGMP(ipv4AllRouters, igmpTypeLeave, group, nil)
+	case 3:
+		dev.sendIGMPReport(version, group, igmpChangeToInclude)
+	}
+	return nil
+}
+
+// 发送单个组的报告, v3 使用 recordType 指定的组记录
+func (dev *device) sendIGMPReport(version int, group [4]byte, recordType uint8) error {
+	switch version {
+	case 1:
+		return dev.sendIGMP(group, igmpTypeV1Report, group, nil)
+	case 2:
+		return dev.sendIGMP(group, igmpTypeV2Report, group, nil)
+	}
+	return dev.sendIGMPv3Report(recordType, [][4]byte{group})
+}
+
+func (dev *device) sendIGMPv3Report(recordType uint8, groups [][4]byte) error {
+	payload := make([]byte, 0, 8*len(groups))
+	for _, group := range groups {
+		payload = append(payload, recordType, 0, 0, 0)
+		payload = append(payload, group[:]...)
+	}
+	// v3 报告的第二个 32 位为 Reserved(16) + 组记录个数(16), 借用 Group 字段来放
+	var counts [4]byte
+	binary.BigEndian.PutUint16(counts[2:], uint16(len(groups)))
+	return dev.sendIGMP(ipv4IGMPv3Routers, igmpTypeV3Report, counts, payload)
+}
+
+// igmp 报文的 TTL 为 1, 并且带有 Router Alert 选项 (RFC 2236, RFC 3376)
+func (dev *device) sendIGMP(dst [4]byte, typ uint8, group [4]byte, payload []byte) error {
+	var msg igmp
+	msg.header.Type = typ
+	msg.header.Group = group
+	msg.payload = payload
+
+	var ip ipv4
+	ip.header.TTL = 1
+	ip.header.Protocol = ipv4ProtocolTypeIGMP
+	if typ == igmpTypeV3Report {
+		ip.header.TOS = 0xc0 // internetwork control
+	}
+	ip.header.Src = dev.selectSourceIPv4(dst)
+	ip.header.Dst = dst
+	ip.options = newIPv4RouterAlertOption()
+	ip.payload = msg.encode()
+	return dev.sendIPv4Multicast(&ip)
+}
+
+// v3 的 Max Resp Code 大于等于 128 时是浮点数表示: 1|exp(3)|mant(4)
+func igmpMaxResp(code uint8) time.Duration {
+	value := int(code)
+	if code >= 128 {
+		value = int(code&0x0f|0x10) << (int(code>>4&0x07) + 3)
+	}
+	return time.Duration(value) * time.Second / 10
+}
+
+func (f igmp) handle(dev *device, upper *ipv4) (err error) {
+	if err = f.decode(upper.payload); err != nil {
+		return
+	}
+	fmt.Printf("%sigmp %s type 0x%x group %v\n", magenta, reset, f.header.Type, net.IP(f.header.Group[:]))
+	st := dev.igmpState()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	switch f.header.Type {
+	case igmpTypeQuery:
+		maxResp := igmpMaxResp(f.header.MaxResp)
+		switch {
+		case len(upper.payload) == 8 && f.header.MaxResp == 0: // v1 查询
+			st.v1Until = time.Now().Add(igmpOlderQuerierTimeout)
+			maxResp = 10 * time.Second
+		case len(upper.payload) == 8: // v2 查询
+			st.v2Until = time.Now().Add(igmpOlderQuerierTimeout)
+		case len(upper.payload) < 12:
+			return errors.New("invalid igmp query")
+		}
+		if maxResp == 0 {
+			maxResp = 100 * time.Millisecond
+		}
+		version := st.versionUnlocked()
+		if f.header.Group == [4]byte{} && version == 3 {
+			dev.scheduleGeneralReportUnlocked(st, maxResp)
+			return errors.New("do nothing")
+		}
+		for _, g := range st.groups {
+			if f.header.Group == [4]byte{} || f.header.Group == g.addr {
+				dev.scheduleReportUnlocked(st, g, maxResp)
+			}
+		}
+	case igmpTypeV1Report, igmpTypeV2Report:
+		// v1/v2 中, 同一网段里有一个主机报告过就够了, 取消自己待发送的报告
+		if g := st.groups[f.header.Group]; g != nil && g.timer != nil && st.versionUnlocked() < 3 {
+			g.timer.Stop()
+			g.timer = nil
+		}
+	}
+	return errors.New("do nothing")
+}
+
+// 在 [0, maxResp) 内随机延迟后回应查询, 已有更早的报告时保持不变
+func (dev *device) scheduleReportUnlocked(st *igmpState, g *igmpGroup, maxResp time.Duration) {
+	delay := time.Duration(rand.Int63n(int64(maxResp)))
+	deadline := time.Now().Add(delay)
+	if g.timer != nil && g.deadline.Before(deadline) {
+		return
+	}
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	g.deadline = deadline
+	g.timer = time.AfterFunc(delay, func() {
+		st.mutex.Lock()
+		if st.groups[g.addr] != g {
+			st.mutex.Unlock()
+			return
+		}
+		g.timer = nil
+		version := st.versionUnlocked()
+		st.mutex.Unlock()
+		dev.sendIGMPReport(version, g.addr, igmpModeIsExclude)
+	})
+}
+
+func (dev *device) scheduleGeneralReportUnlocked(st *igmpState, maxResp time.Duration) {
+	if st.general != nil {
+		return
+	}
+	st.general = time.AfterFunc(time.Duration(rand.Int63n(int64(maxResp))), func() {
+		st.mutex.Lock()
+		st.general = nil
+		groups := make([][4]byte, 0, len(st.groups))
+		for addr := range st.groups {
+			groups = append(groups, addr)
+		}
+		st.mutex.Unlock()
+		if len(groups) > 0 {
+			dev.sendIGMPv3Report(igmpModeIsExclude, groups)
+		}
+	})
+}
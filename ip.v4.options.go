@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+/*
+	ip 首部选项, 位于固定的 20 字节首部之后, 最多 40 字节
+	除了 EOL 和 NOP 只有一个字节外, 其余选项的格式都是 type(1) + length(1) + data
+	type 的最高位 (copied flag) 表示分片时是否需要把该选项复制到每一个分片中
+
+	Record Route / Source Route:
+	+--------+--------+--------+---------//--------+
+	|  type  | length | pointer|     route data    |
+	+--------+--------+--------+---------//--------+
+	Timestamp:
+	+--------+--------+--------+--------+---------//--------+
+	|  68    | length | pointer|oflw|flg|   timestamp data  |
+	+--------+--------+--------+--------+---------//--------+
+	pointer 是相对于选项起始的下标 (从 1 开始), 指向下一个可以写入的位置
+*/
+const (
+	ipv4OptionEOL         = 0
+	ipv4OptionNOP         = 1
+	ipv4OptionRecordRoute = 7
+	ipv4OptionTimestamp   = 68
+	ipv4OptionLSRR        = 131 // Loose Source and Record Route
+	ipv4OptionSSRR        = 137 // Strict Source and Record Route
+	ipv4OptionRouterAlert = 148
+
+	ipv4OptionCopied = 0x80
+
+	ipv4TimestampOnly         = 0 // 只记录时间戳
+	ipv4TimestampAndAddress   = 1 // 记录地址和时间戳
+	ipv4TimestampPrespecified = 3 // 只有地址与预先指定的地址相同时才记录
+)
+
+// 选项出错时回复 icmp parameter problem, pointer 指向出错的字节在首部中的位置
+type ipv4ParameterProblemError struct {
+	pointer int
+	reason  string
+}
+
+func (e *ipv4ParameterProblemError) Error() string {
+	return fmt.Sprintf("ip parameter problem at %d: %s", e.pointer, e.reason)
+}
+
+type ipv4Option struct {
+	kind   uint8
+	offset int    // 选项在首部中的位置
+	data   []byte // 整个选项, 包括 type 和 length, 与 ipv4.options 共享内存
+}
+
+func (f *ipv4) headerLen() int {
+	return 20 + (len(f.options)+3)&^3
+}
+
+// 解析并校验选项
+func (f *ipv4) parseOptions() ([]ipv4Option, error) {
+	var list []ipv4Option
+	var seen [256]bool // 收包路径上每个带选项的数据报都会解析, 不在堆上分配
+	problem := func(i int, reason string) error {
+		return &ipv4ParameterProblemError{pointer: 20 + i, reason: reason}
+	}
+	for i := 0; i < len(f.options); {
+		kind := f.options[i]
+		if kind == ipv4OptionEOL {
+			break
+		}
+		if kind == ipv4OptionNOP {
+			i++
+			continue
+		}
+		if i+1 >= len(f.options) {
+			return nil, problem(i, "option truncated")
+		}
+		length := int(f.options[i+1])
+		if length < 2 || i+length > len(f.options) {
+			return nil, problem(i+1, "bad option length")
+		}
+		opt := ipv4Option{kind: kind, offset: 20 + i, data: f.options[i : i+length]}
+		if kind == ipv4OptionLSRR || kind == ipv4OptionSSRR {
+			if seen[ipv4OptionLSRR] || seen[ipv4OptionSSRR] {
+				return nil, problem(i, "duplicate source route option")
+			}
+		} else if seen[kind] {
+			return nil, problem(i, "duplicate option")
+		}
+		seen[kind] = true
+		switch kind {
+		case ipv4OptionRecordRoute, ipv4OptionLSRR, ipv4OptionSSRR:
+			if length < 3 || (length-3)%4 != 0 {
+				return nil, problem(i+1, "bad route option length")
+			}
+			if ptr := int(opt.data[2]); ptr < 4 || (ptr-4)%4 != 0 {
+				return nil, problem(i+2, "bad route option pointer")
+			}
+		case ipv4OptionTimestamp:
+			if length < 4 {
+				return nil, problem(i+1, "bad timestamp option length")
+			}
+			size := 4
+			switch opt.data[3] & 0x0f {
+			case ipv4TimestampOnly:
+			case ipv4TimestampAndAddress, ipv4TimestampPrespecified:
+				size = 8
+			default:
+				return nil, problem(i+3, "bad timestamp option flag")
+			}
+			if (length-4)%size != 0 {
+				return nil, problem(i+1, "bad timestamp option length")
+			}
+			if ptr := int(opt.data[2]); ptr < 5 || (ptr-5)%size != 0 {
+				return nil, problem(i+2, "bad timestamp option pointer")
+			}
+		case ipv4OptionRouterAlert:
+			if length != 4 {
+				return nil, problem(i+1, "bad router alert option length")
+			}
+		}
+		list = append(list, opt)
+		i += length
+	}
+	return list, nil
+}
+
+func findIPv4Option(list []ipv4Option, kinds ...uint8) *ipv4Option {
+	for i := range list {
+		for _, kind := range kinds {
+			if list[i].kind == kind {
+				return &list[i]
+			}
+		}
+	}
+	return nil
+}
+
+// 源路由中是否还有没有走完的地址, 有则返回下一个地址
+func (opt *ipv4Option) nextHop() ([4]byte, bool) {
+	var addr [4]byte
+	ptr := int(opt.data[2])
+	if ptr+3 > len(opt.data) {
+		return addr, false
+	}
+	copy(addr[:], opt.data[ptr-1:ptr+3])
+	return addr, true
+}
+
+/*
+	数据报的目的地址是自己, 但是源路由还没有走完时:
+	把目的地址换成源路由中的下一个地址, 并把自己的出口地址记录在原位置, pointer 后移
+	返回是否为严格源路由, 严格源路由要求下一跳必须直连
+*/
+func (f *ipv4) applySourceRoute(list []ipv4Option, out [4]byte) (strict bool, ok bool) {
+	opt := findIPv4Option(list, ipv4OptionLSRR, ipv4OptionSSRR)
+	if opt == nil {
+		return false, false
+	}
+	next, ok := opt.nextHop()
+	if !ok {
+		return false, false
+	}
+	ptr := int(opt.data[2])
+	copy(opt.data[ptr-1:ptr+3], out[:])
+	opt.data[2] += 4
+	f.header.Dst = next
+	return opt.kind == ipv4OptionSSRR, true
+}
+
+// 转发时对 Record Route 和 Timestamp 的处理, out 是出口的地址
+func (f *ipv4) forwardOptions(list []ipv4Option, out [4]byte) error {
+	if opt := findIPv4Option(list, ipv4OptionRecordRoute); opt != nil {
+		if ptr := int(opt.data[2]); ptr+3 <= len(opt.data) { // 已经记满的不再记录
+			copy(opt.data[ptr-1:ptr+3], out[:])
+			opt.data[2] += 4
+		}
+	}
+	if opt := findIPv4Option(list, ipv4OptionTimestamp); opt != nil {
+		return opt.stamp(out)
+	}
+	return nil
+}
+
+// 记录时间戳, 空间不足时增加溢出计数, 溢出计数也溢出时返回 parameter problem
+func (opt *ipv4Option) stamp(addr [4]byte) error {
+	ptr := int(opt.data[2])
+	flag := opt.data[3] & 0x0f
+	size := 4
+	if flag != ipv4TimestampOnly {
+		size = 8
+	}
+	if ptr+size-1 > len(opt.data) {
+		overflow := opt.data[3] >> 4
+		if overflow == 0x0f {
+			return &ipv4ParameterProblemError{pointer: opt.offset + 3, reason: "timestamp overflow"}
+		}
+		opt.data[3] = (overflow+1)<<4 | flag
+		return nil
+	}
+	slot := opt.data[ptr-1 : ptr-1+size]
+	switch flag {
+	case ipv4TimestampAndAddress:
+		copy(slot[:4], addr[:])
+		slot = slot[4:]
+	case ipv4TimestampPrespecified:
+		if [4]byte{slot[0], slot[1], slot[2], slot[3]} != addr {
+			return nil
+		}
+		slot = slot[4:]
+	}
+	binary.BigEndian.PutUint32(slot, ipv4Timestamp())
+	opt.data[2] += byte(size)
+	return nil
+}
+
+// 从 UTC 零点开始的毫秒数
+func ipv4Timestamp() uint32 {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(now.Sub(midnight) / time.Millisecond)
+}
+
+// 分片时只有设置了 copied flag 的选项会出现在后续的分片中
+func copiedIPv4Options(options []byte) []byte {
+	var copied []byte
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if kind == ipv4OptionEOL {
+			break
+		}
+		if kind == ipv4OptionNOP || i+1 >= len(options) {
+			i++
+			continue
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			break
+		}
+		if kind&ipv4OptionCopied != 0 {
+			copied = append(copied, options[i:i+length]...)
+		}
+		i += length
+	}
+	return copied
+}
+
+// 以下用于生成选项, 多个选项直接拼接即可, encode 会补齐到 4 字节对齐
+func newIPv4RecordRouteOption(slots int) []byte {
+	opt := make([]byte, 3+4*slots)
+	opt[0], opt[1], opt[2] = ipv4OptionRecordRoute, byte(len(opt)), 4
+	return opt
+}
+
+func newIPv4TimestampOption(flag uint8, slots int) []byte {
+	size := 4
+	if flag != ipv4TimestampOnly {
+		size = 8
+	}
+	opt := make([]byte, 4+size*slots)
+	opt[0], opt[1], opt[2], opt[3] = ipv4OptionTimestamp, byte(len(opt)), 5, flag
+	return opt
+}
+
+// route 中是经过的路由器地址, 最终目的地址放在最后
+func newIPv4SourceRouteOption(strict bool, route [][4]byte) []byte {
+	opt := make([]byte, 3, 3+4*len(route))
+	opt[0], opt[2] = ipv4OptionLSRR, 4
+	if strict {
+		opt[0] = ipv4OptionSSRR
+	}
+	for _, addr := range route {
+		opt = append(opt, addr[:]...)
+	}
+	opt[1] = byte(len(opt))
+	return opt
+}
+
+func newIPv4RouterAlertOption() []byte {
+	return []byte{ipv4OptionRouterAlert, 4, 0, 0}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+/*
+	ipv4 的路径 MTU 缓存, 地址转换成 ipv4 映射地址
+	下限取 552 (与 Linux 的 min_pmtu 相同), 避免伪造的差错报文把 MTU 压到 68 使数据报被切成大量分片
+*/
+const ipv4MinPathMTU = 552
+
+var ipv4PathMTUs = newPathMTUCache(ipv4MinPathMTU)
+
+// 发往 dst 时使用的 MTU, 取链路 MTU 和路径 MTU 中较小的
+func (dev *device) pathMTU(dst [4]byte) int {
+	mtu := dev.linkMTU()
+	if pmtu := ipv4PathMTUs.lookup(dev.vrf(), ipv4MappedIPv6(dst)); pmtu != 0 && pmtu < mtu {
+		mtu = pmtu
+	}
+	return mtu
+}
+
+// 数据报超过了 MTU 但是设置了 DF, 转发时需要回复 icmp fragmentation needed
+type fragmentationNeededError struct {
+	mtu int
+}
+
+func (e *fragmentationNeededError) Error() string {
+	return fmt.Sprintf("fragmentation needed and DF set (mtu %d)", e.mtu)
+}
+
+/*
+	各协议发送 ip 数据报的统一入口
+	src 为 0 时由出口设备选择源地址, ttl 为 0 时使用 ipv4DefaultTTL
+	传输层的校验和包含源地址, 这类调用者应当先用 selectSourceIPv4 确定源地址再构造 payload
+*/
+func (v *vrf) ipv4Output(src, dst [4]byte, protocol ipv4ProtocolType, payload []byte, tos, ttl uint8) error {
+	var f ipv4
+	f.header.TOS = tos
+	f.header.TTL = ttl
+	f.header.Protocol = protocol
+	f.header.Src = src
+	f.header.Dst = dst
+	f.payload = payload
+	return v.sendIPv4(&f)
+}
+
+// 发往 dst 时使用的源地址, 没有路由时返回 0.0.0.0
+func (v *vrf) selectSourceIPv4(dst [4]byte, mark uint32) [4]byte {
+	route, nextHop := v.rules.lookup(ipv4FlowKey{dst: dst, mark: mark})
+	if route == nil {
+		return [4]byte{}
+	}
+	return route.dev.selectSourceIPv4(nextHop)
+}
+
+/*
+	主动发送一个 ip 数据报, 由调用者填好 Dst, Protocol 和 payload, 需要携带选项时直接调用它
+	通过 VRF 的路由表选择出口设备和下一跳, Src 为空时由出口设备选择源地址
+	版本, 首部长度和总长度在 encode 时填写, Id 总是重新分配
+	下一跳的 mac 不在 ARP 缓存中时, 数据报会先挂起, 解析完成后再发送
+	发往组播和出口设备上的广播地址时不需要 ARP, 目的 mac 由地址直接得到
+*/
+func (v *vrf) sendIPv4(f *ipv4) error {
+	route, nextHop := v.rules.lookup(ipv4FlowOf(f, nil))
+	if route == nil {
+		return fmt.Errorf("no route to %v", net.IP(f.header.Dst[:]))
+	}
+	dev := route.dev
+	if f.header.Src == [4]byte{} {
+		f.header.Src = dev.selectSourceIPv4(nextHop)
+	}
+	if f.header.TTL == 0 {
+		f.header.TTL = ipv4DefaultTTL
+	}
+	f.assignId()
+	switch {
+	case ipv4IsMulticast(f.header.Dst):
+		return dev.transmitIPv4(f, ipv4MulticastMAC(f.header.Dst))
+	case dev.isIPv4Broadcast(f.header.Dst):
+		return dev.transmitIPv4(f, ethBroadcast)
+	}
+	return dev.outputIPv4(f, nextHop, nil)
+}
+
+// 从设备上直接发送组播数据报, 组播不查路由表也不需要 ARP, 目的 mac 由组地址映射得到
+func (dev *device) sendIPv4Multicast(f *ipv4) error {
+	if f.header.Src == [4]byte{} {
+		f.header.Src = dev.selectSourceIPv4(f.header.Dst)
+	}
+	if f.header.TTL == 0 {
+		f.header.TTL = 1
+	}
+	f.assignId()
+	return dev.transmitIPv4(f, ipv4MulticastMAC(f.header.Dst))
+}
+
+/*
+	把数据报发送给 mac 为 dst 的下一跳, 超过设备 MTU 或者到目的地址的路径 MTU 时进行分片
+	- 每个分片都带有原数据报的首部, 数据长度 (除最后一个分片外) 是 8 的整数倍
+	- 第一个分片之后的分片只携带设置了 copied flag 的选项
+	- 分片的偏移要加上原数据报自身的偏移, 原数据报设置了 MF 时, 最后一个分片也要保留 MF
+	- 设置了 DF 的数据报不能分片, 返回 fragmentationNeededError
+*/
+func (dev *device) transmitIPv4(f *ipv4, dst [6]byte) error {
+	hlen := f.headerLen()
+	mtu := dev.pathMTU(f.header.Dst)
+	if hlen+len(f.payload) <= mtu {
+		return dev.send(dst, ethernetTypeIPv4, f.encode())
+	}
+	if f.header.Flags_FragmentOffset&IPv4FlagDontFragment != 0 {
+		return &fragmentationNeededError{mtu: mtu}
+	}
+	chunk := (mtu - hlen) &^ 7
+	if chunk <= 0 {
+		return fmt.Errorf("mtu %d too small to fragment", mtu)
+	}
+	offset := int(f.header.Flags_FragmentOffset&ipv4FragmentOffsetMask) << 3
+	more := f.header.Flags_FragmentOffset & IPv4FlagMoreFragments
+	for pos := 0; pos < len(f.payload); pos += chunk {
+		end := pos + chunk
+		frag := *f
+		frag.header.Flags_FragmentOffset = uint16((offset+pos)>>3) | more
+		if end < len(f.payload) {
+			frag.header.Flags_FragmentOffset |= IPv4FlagMoreFragments
+		} else {
+			end = len(f.payload)
+		}
+		frag.payload = f.payload[pos:end]
+		if pos > 0 {
+			frag.options = copiedIPv4Options(f.options)
+		}
+		if err := dev.send(dst, ethernetTypeIPv4, frag.encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
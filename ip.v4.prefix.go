@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ipv4 网段, 如 10.1.0.0/24
+type ipv4Prefix struct {
+	addr [4]byte
+	len  uint8
+}
+
+func parseIPv4Prefix(s string) (p ipv4Prefix, err error) {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil || ipnet.IP.To4() == nil {
+		return p, fmt.Errorf("invalid ipv4 prefix %q", s)
+	}
+	ones, _ := ipnet.Mask.Size()
+	copy(p.addr[:], ipnet.IP.To4())
+	p.len = uint8(ones)
+	return p, nil
+}
+
+func (p ipv4Prefix) mask() uint32 {
+	if p.len == 0 {
+		return 0
+	}
+	return ^uint32(0) << (32 - p.len)
+}
+
+func (p ipv4Prefix) contains(addr [4]byte) bool {
+	m := p.mask()
+	return binary.BigEndian.Uint32(addr[:])&m == binary.BigEndian.Uint32(p.addr[:])&m
+}
+
+func (p ipv4Prefix) String() string {
+	return fmt.Sprintf("%v/%d", net.IP(p.addr[:]), p.len)
+}
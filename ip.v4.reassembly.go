@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	ip 数据报重组
+	当上层数据报超过了 MTU, 发送方会在 ip 层拆包, 接收方要按 (src, dst, protocol, id) 把分片组装回来
+	- 分片之间重叠时, 先到的数据为准, 新分片只保留没有被覆盖的部分
+	- 每个数据报从收到第一个分片开始计时, 超时后丢弃, 若已收到偏移为 0 的分片, 回复 icmp 重组超时
+	- 所有未完成数据报占用的内存超过 ipv4ReassemblyHigh 时, 从最老的开始丢弃, 直到低于 ipv4ReassemblyLow
+*/
+const (
+	ipv4ReassemblyTimeout = 30 * time.Second
+	ipv4ReassemblyHigh    = 4 << 20
+	ipv4ReassemblyLow     = 3 << 20
+	ipv4MaxDatagramSize   = 0xffff
+)
+
+type ipv4FragmentKey struct {
+	vrf      *vrf // 不同 VRF 中可能出现相同的地址
+	src, dst [4]byte
+	protocol ipv4ProtocolType
+	id       uint16
+}
+
+type ipv4Fragment struct {
+	offset int
+	data   []byte
+}
+
+type ipv4FragmentQueue struct {
+	key       ipv4FragmentKey
+	dev       *device
+	first     *ipv4          // 偏移为 0 的分片, 重组后的首部以它为准
+	fragments []ipv4Fragment // 按 offset 排序, 互不重叠
+	total     int            // 收到最后一个分片后才能确定数据报的长度, 之前为 -1
+	size      int            // 已经收到的数据字节数
+	created   time.Time
+	timer     *time.Timer
+}
+
+type ipv4Reassembler struct {
+	queues map[ipv4FragmentKey]*ipv4FragmentQueue
+	mem    int
+	mutex  sync.Mutex
+}
+
+var ipv4Fragments = newIPv4Reassembler()
+
+func newIPv4Reassembler() *ipv4Reassembler {
+	return &ipv4Reassembler{
+		queues: make(map[ipv4FragmentKey]*ipv4FragmentQueue),
+	}
+}
+
+// 加入一个分片, 数据报收齐时返回重组后的数据报, 否则返回 nil
+func (r *ipv4Reassembler) add(dev *device, f *ipv4) (*ipv4, error) {
+	offset := int(f.header.Flags_FragmentOffset&ipv4FragmentOffsetMask) << 3
+	more := f.header.Flags_FragmentOffset&IPv4FlagMoreFragments != 0
+	hlen := f.headerLen()
+	end := offset + len(f.payload)
+	if hlen+end > ipv4MaxDatagramSize {
+		return nil, fmt.Errorf("fragment exceeds max datagram size (%d)", hlen+end)
+	}
+	if more && len(f.payload)&7 != 0 { // 除了最后一个分片, 分片长度必须是 8 的整数倍
+		return nil, errors.New("fragment length is not a multiple of 8")
+	}
+	key := ipv4FragmentKey{vrf: dev.vrf(), src: f.header.Src, dst: f.header.Dst, protocol: f.header.Protocol, id: f.header.Id}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	q := r.queues[key]
+	if q == nil {
+		q = &ipv4FragmentQueue{key: key, dev: dev, total: -1, created: time.Now()}
+		q.timer = time.AfterFunc(ipv4ReassemblyTimeout, func() { r.expire(q) })
+		r.queues[key] = q
+	}
+	if !more {
+		if q.total >= 0 && q.total != end || end < q.end() {
+			r.dropUnlocked(q)
+			return nil, errors.New("inconsistent fragment length")
+		}
+		q.total = end
+	} else if q.total >= 0 && end > q.total {
+		r.dropUnlocked(q)
+		return nil, errors.New("fragment beyond end of datagram")
+	}
+	if offset == 0 && q.first == nil {
+		first := *f
+		first.options = append([]byte(nil), f.options...)
+		first.payload = append([]byte(nil), f.payload...)
+		q.first = &first
+	}
+	r.mem += q.insert(offset, f.payload)
+	if !q.complete() {
+		r.evictUnlocked()
+		return nil, errors.New("fragment queued")
+	}
+	r.dropUnlocked(q)
+	return q.assemble(), nil
+}
+
+// 插入新分片中没有被已有分片覆盖的部分, 返回新增的字节数
+func (q *ipv4FragmentQueue) insert(start int, data []byte) int {
+	end := start + len(data)
+	cur, added := start, 0
+	var pieces []ipv4Fragment
+	for _, frag := range q.fragments {
+		fs, fe := frag.offset, frag.offset+len(frag.data)
+		if fe <= cur {
+			continue
+		}
+		if fs >= end {
+			break
+		}
+		if fs > cur {
+			pieces = append(pieces, ipv4Fragment{offset: cur, data: data[cur-start : fs-start]})
+		}
+		cur = fe
+	}
+	if cur < end {
+		pieces = append(pieces, ipv4Fragment{offset: cur, data: data[cur-start:]})
+	}
+	for _, piece := range pieces {
+		piece.data = append([]byte(nil), piece.data...) // 收包的缓冲区会被复用, 需要拷贝
+		added += len(piece.data)
+		q.fragments = append(q.fragments, piece)
+	}
+	sort.Slice(q.fragments, func(i, j int) bool {
+		return q.fragments[i].offset < q.fragments[j].offset
+	})
+	q.size += added
+	return added
+}
+
+func (q *ipv4FragmentQueue) end() int {
+	if len(q.fragments) == 0 {
+		return 0
+	}
+	last := q.fragments[len(q.fragments)-1]
+	return last.offset + len(last.data)
+}
+
+func (q *ipv4FragmentQueue) complete() bool {
+	return q.first != nil && q.total >= 0 && q.size == q.total
+}
+
+func (q *ipv4FragmentQueue) assemble() *ipv4 {
+	whole := *q.first
+	whole.payload = make([]byte, 0, q.total)
+	for _, frag := range q.fragments {
+		whole.payload = append(whole.payload, frag.data...)
+	}
+	whole.header.Flags_FragmentOffset &^= IPv4FlagMoreFragments | ipv4FragmentOffsetMask
+	whole.header.Len = uint16(whole.headerLen() + q.total)
+	return &whole
+}
+
+func (r *ipv4Reassembler) dropUnlocked(q *ipv4FragmentQueue) {
+	if r.queues[q.key] != q {
+		return
+	}
+	q.timer.Stop()
+	delete(r.queues, q.key)
+	r.mem -= q.size
+}
+
+// 内存超限时从最老的数据报开始丢弃
+func (r *ipv4Reassembler) evictUnlocked() {
+	if r.mem <= ipv4ReassemblyHigh {
+		return
+	}
+	queues := make([]*ipv4FragmentQueue, 0, len(r.queues))
+	for _, q := range r.queues {
+		queues = append(queues, q)
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].created.Before(queues[j].created)
+	})
+	for _, q := range queues {
+		if r.mem <= ipv4ReassemblyLow {
+			break
+		}
+		r.dropUnlocked(q)
+	}
+}
+
+func (r *ipv4Reassembler) expire(q *ipv4FragmentQueue) {
+	r.mutex.Lock()
+	if r.queues[q.key] != q {
+		r.mutex.Unlock()
+		return
+	}
+	r.dropUnlocked(q)
+	r.mutex.Unlock()
+	if q.first != nil {
+		if err := q.dev.sendIcmpError(q.first, icmpTypeTimeExceeded, icmpCodeReassemblyExceeded, 0); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+/*
+	路由表
+	查找时选择前缀最长的路由 (longest prefix match), 前缀长度相同时选择 metric 最小的
+	gateway 为 0.0.0.0 表示目的地址直连, 下一跳就是目的地址本身
+	设备的网段会自动生成直连路由, 默认路由即 0.0.0.0/0
+*/
+type ipv4Route struct {
+	prefix    ipv4Prefix
+	gateway   [4]byte
+	dev       *device
+	metric    int
+	connected bool // 由设备地址自动生成的直连路由
+}
+
+type ipv4RouteTable struct {
+	storage []*ipv4Route
+	mutex   sync.RWMutex
+}
+
+var ipv4Routes = newIPv4RouteTable()
+
+func newIPv4RouteTable() *ipv4RouteTable {
+	return &ipv4RouteTable{}
+}
+
+func (tbl *ipv4RouteTable) add(route *ipv4Route) error {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for _, r := range tbl.storage {
+		if r.prefix == route.prefix && r.metric == route.metric {
+			return errors.New("route already exists")
+		}
+	}
+	tbl.storage = append(tbl.storage, route)
+	// 按前缀长度从长到短排序, 这样查找时第一个匹配的就是最长前缀
+	sort.SliceStable(tbl.storage, func(i, j int) bool {
+		if tbl.storage[i].prefix.len != tbl.storage[j].prefix.len {
+			return tbl.storage[i].prefix.len > tbl.storage[j].prefix.len
+		}
+		return tbl.storage[i].metric < tbl.storage[j].metric
+	})
+	return nil
+}
+
+// 删除匹配的路由, metric 小于 0 时不比较 metric
+func (tbl *ipv4RouteTable) remove(prefix ipv4Prefix, metric int) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for i, r := range tbl.storage {
+		if r.prefix == prefix && (metric < 0 || r.metric == metric) {
+			tbl.storage = append(tbl.storage[:i], tbl.storage[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (tbl *ipv4RouteTable) removeConnected(dev *device, prefix ipv4Prefix) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for i, r := range tbl.storage {
+		if r.connected && r.dev == dev && r.prefix == prefix {
+			tbl.storage = append(tbl.storage[:i], tbl.storage[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (tbl *ipv4RouteTable) removeDevice(dev *device) {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	kept := tbl.storage[:0]
+	for _, r := range tbl.storage {
+		if r.dev != dev {
+			kept = append(kept, r)
+		}
+	}
+	tbl.storage = kept
+}
+
+// 返回匹配的路由以及下一跳地址
+func (tbl *ipv4RouteTable) lookup(dst [4]byte) (*ipv4Route, [4]byte) {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	for _, r := range tbl.storage {
+		if r.prefix.contains(dst) {
+			if r.gateway == [4]byte{} {
+				return r, dst
+			}
+			return r, r.gateway
+		}
+	}
+	return nil, dst
+}
+
+func (tbl *ipv4RouteTable) entries() []ipv4Route {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	list := make([]ipv4Route, 0, len(tbl.storage))
+	for _, r := range tbl.storage {
+		list = append(list, *r)
+	}
+	return list
+}
+
+// 为设备的网段在设备所属 VRF 的 main 表中添加直连路由
+func (dev *device) addConnectedRoute(prefix ipv4Prefix) error {
+	prefix.addr = maskIPv4(prefix.addr, prefix)
+	return dev.vrf().rules.table(ipv4TableMain, true).add(&ipv4Route{prefix: prefix, dev: dev, connected: true})
+}
+
+func maskIPv4(addr [4]byte, prefix ipv4Prefix) [4]byte {
+	var masked [4]byte
+	m := prefix.mask()
+	for i := range masked {
+		masked[i] = addr[i] & byte(m>>(24-8*i))
+	}
+	return masked
+}
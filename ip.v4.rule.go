@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+/*
+	策略路由, 与 ip rule 相同
+	路由规则按 priority 从小到大依次匹配, 匹配条件包括源地址, 入口设备, TOS 和 fwmark,
+	命中的规则指定查哪张路由表, 表中没有匹配的路由时继续尝试下一条规则
+	默认只有两条规则: 32766 查 main 表, 32767 查 default 表
+	本机发出的数据报没有入口设备, 只能匹配不带 iif 的规则
+*/
+const (
+	ipv4TableDefault = 253
+	ipv4TableMain    = 254
+	ipv4TableLocal   = 255
+)
+
+// 一次路由查找的输入
+type ipv4FlowKey struct {
+	dst, src [4]byte
+	iif      *device // 转发时的入口设备, 本机发出时为 nil
+	tos      uint8
+	mark     uint32
+}
+
+func ipv4FlowOf(f *ipv4, iif *device) ipv4FlowKey {
+	return ipv4FlowKey{dst: f.header.Dst, src: f.header.Src, iif: iif, tos: f.header.TOS, mark: f.mark}
+}
+
+type ipv4Rule struct {
+	priority int
+	src      ipv4Prefix // 长度为 0 时匹配任意源地址
+	iif      *device    // nil 时匹配任意入口
+	tos      uint8      // 0 时匹配任意 TOS
+	mark     uint32
+	mask     uint32 // fwmark 的掩码, 为 0 时不比较 fwmark
+	table    int
+}
+
+func (r *ipv4Rule) match(key *ipv4FlowKey) bool {
+	if r.src.len != 0 && !r.src.contains(key.src) {
+		return false
+	}
+	if r.iif != nil && r.iif != key.iif {
+		return false
+	}
+	if r.tos != 0 && r.tos != key.tos&^0x03 { // 忽略 ECN 位
+		return false
+	}
+	return key.mark&r.mask == r.mark&r.mask
+}
+
+type ipv4RuleList struct {
+	storage []*ipv4Rule
+	tables  map[int]*ipv4RouteTable
+	mutex   sync.RWMutex
+}
+
+var ipv4Rules = newIPv4RuleList(ipv4Routes)
+
+// 新建只有默认规则的规则列表, main 为其中的 main 表
+func newIPv4RuleList(main *ipv4RouteTable) *ipv4RuleList {
+	return &ipv4RuleList{
+		storage: []*ipv4Rule{
+			{priority: 32766, table: ipv4TableMain},
+			{priority: 32767, table: ipv4TableDefault},
+		},
+		tables: map[int]*ipv4RouteTable{
+			ipv4TableMain:    main,
+			ipv4TableDefault: newIPv4RouteTable(),
+			ipv4TableLocal:   newIPv4RouteTable(),
+		},
+	}
+}
+
+// 返回编号为 id 的路由表, create 为真时不存在则新建
+func (rules *ipv4RuleList) table(id int, create bool) *ipv4RouteTable {
+	rules.mutex.Lock()
+	defer rules.mutex.Unlock()
+	tbl := rules.tables[id]
+	if tbl == nil && create {
+		tbl = newIPv4RouteTable()
+		rules.tables[id] = tbl
+	}
+	return tbl
+}
+
+func (rules *ipv4RuleList) tableIDs() []int {
+	rules.mutex.RLock()
+	defer rules.mutex.RUnlock()
+	ids := make([]int, 0, len(rules.tables))
+	for id := range rules.tables {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// priority 为 0 时取第一条规则的 priority 减 1, 与 ip rule 的行为一致
+func (rules *ipv4RuleList) add(rule *ipv4Rule) error {
+	if rule.table <= 0 {
+		return errors.New("rule needs a table")
+	}
+	rules.mutex.Lock()
+	defer rules.mutex.Unlock()
+	if rule.priority == 0 && len(rules.storage) > 0 && rules.storage[0].priority > 1 {
+		rule.priority = rules.storage[0].priority - 1
+	}
+	for _, r := range rules.storage {
+		if *r == *rule {
+			return errors.New("rule already exists")
+		}
+	}
+	if rules.tables[rule.table] == nil {
+		rules.tables[rule.table] = newIPv4RouteTable()
+	}
+	rules.storage = append(rules.storage, rule)
+	sort.SliceStable(rules.storage, func(i, j int) bool {
+		return rules.storage[i].priority < rules.storage[j].priority
+	})
+	return nil
+}
+
+// 删除第一条与 match 返回真的规则
+func (rules *ipv4RuleList) remove(match func(r *ipv4Rule) bool) bool {
+	rules.mutex.Lock()
+	defer rules.mutex.Unlock()
+	for i, r := range rules.storage {
+		if match(r) {
+			rules.storage = append(rules.storage[:i], rules.storage[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (rules *ipv4RuleList) entries() []ipv4Rule {
+	rules.mutex.RLock()
+	defer rules.mutex.RUnlock()
+	list := make([]ipv4Rule, 0, len(rules.storage))
+	for _, r := range rules.storage {
+		list = append(list, *r)
+	}
+	return list
+}
+
+// 设备离开时, 删除所有经过它的路由以及以它为入口的规则
+func (rules *ipv4RuleList) removeDevice(dev *device) {
+	rules.mutex.Lock()
+	defer rules.mutex.Unlock()
+	kept := rules.storage[:0]
+	for _, r := range rules.storage {
+		if r.iif != dev {
+			kept = append(kept, r)
+		}
+	}
+	rules.storage = kept
+	for _, tbl := range rules.tables {
+		tbl.removeDevice(dev)
+	}
+}
+
+// 按规则依次查表, 返回匹配的路由以及下一跳地址
+func (rules *ipv4RuleList) lookup(key ipv4FlowKey) (*ipv4Route, [4]byte) {
+	rules.mutex.RLock()
+	var tables []*ipv4RouteTable
+	for _, r := range rules.storage {
+		if r.match(&key) && rules.tables[r.table] != nil {
+			tables = append(tables, rules.tables[r.table])
+		}
+	}
+	rules.mutex.RUnlock()
+	for _, tbl := range tables {
+		if route, nextHop := tbl.lookup(key.dst); route != nil {
+			return route, nextHop
+		}
+	}
+	return nil, key.dst
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+)
+
+/*
+	ipv6 源端分片以及路径 MTU
+	路由器不对 ipv6 数据报分片, 数据报超过路径上某条链路的 MTU 时, 路由器丢弃它并回复 Packet Too Big,
+	源端记下该目的地址的路径 MTU, 之后发往该地址的数据报在本机分片 (RFC 8201), 路径 MTU 不会小于 1280
+*/
+var ipv6PathMTUs = newPathMTUCache(ipv6MinMTU)
+
+// 发往 dst 时使用的 MTU, 取链路 MTU 和路径 MTU 中较小的
+func (dev *device) pathMTU6(dst [16]byte) int {
+	mtu := dev.ipv6MTU()
+	if pmtu := ipv6PathMTUs.lookup(dev.vrf(), dst); pmtu != 0 && pmtu < mtu {
+		mtu = pmtu
+	}
+	return mtu
+}
+
+/*
+	Identification 复用 ipv4 按目的分桶的生成器, 只是 ipv6 的 Id 是 32 位,
+	这样不会被用来推测发给其它主机的流量
+*/
+var ipv6Idents = newIPv4IdentGenerator()
+
+func (g *ipv4IdentGenerator) next6(src, dst [16]byte) uint32 {
+	var key [36]byte
+	binary.BigEndian.PutUint32(key[:4], g.secret)
+	copy(key[4:20], src[:])
+	copy(key[20:36], dst[:])
+	h := fnv.New32a()
+	h.Write(key[:])
+	return atomic.AddUint32(&g.idents[h.Sum32()%ipv4IdentBuckets], 1)
+}
+
+// Hop-by-Hop 和 Routing 首部 (以及它们之前的首部) 需要路径上的节点处理, 属于不可分片部分
+func (f *ipv6) unfragmentableLen() int {
+	n := 0
+	for i, ext := range f.extensions {
+		if ext.kind == ipv6HeaderHopByHop || ext.kind == ipv6HeaderRouting {
+			n = i + 1
+		}
+	}
+	return n
+}
+
+/*
+	把数据报分成不超过 mtu 的分片
+	每个分片是 不可分片部分 + Fragment 首部 + 一段可分片部分, 除最后一个外数据长度是 8 的整数倍
+*/
+func (f *ipv6) fragment(mtu int) ([][]byte, error) {
+	split := f.unfragmentableLen()
+	head := *f
+	head.extensions = f.extensions[:split]
+	tail := ipv6{extensions: f.extensions[split:], protocol: f.protocol, payload: f.payload}
+	fragmentable := tail.encode()[ipv6HeaderSize:]
+	next := f.protocol
+	if len(tail.extensions) > 0 {
+		next = tail.extensions[0].kind
+	}
+
+	hlen := ipv6HeaderSize + 8
+	for _, ext := range head.extensions {
+		hlen += len(ext.data)
+	}
+	chunk := (mtu - hlen) &^ 7
+	if chunk <= 0 {
+		return nil, errMTUTooSmall
+	}
+	id := ipv6Idents.next6(f.header.Src, f.header.Dst)
+	var frames [][]byte
+	for pos := 0; pos < len(fragmentable); pos += chunk {
+		end := pos + chunk
+		more := uint16(ipv6FragmentMore)
+		if end >= len(fragmentable) {
+			end, more = len(fragmentable), 0
+		}
+		ext := make([]byte, 8)
+		ext[0] = byte(next)
+		binary.BigEndian.PutUint16(ext[2:4], uint16(pos)|more)
+		binary.BigEndian.PutUint32(ext[4:8], id)
+		frag := head
+		frag.extensions = append(append([]ipv6Extension(nil), head.extensions...), ipv6Extension{kind: ipv6HeaderFragment, data: ext})
+		frag.protocol = next
+		frag.payload = fragmentable[pos:end]
+		frames = append(frames, frag.encode())
+	}
+	return frames, nil
+}
+
+/*
+	Packet Too Big: MTU(32) 之后是引用的原数据报
+	引用的数据报必须是本机发出的, 否则可能是伪造的报文
+*/
+func (dev *device) handlePacketTooBig(f *icmpv6) error {
+	if len(f.payload) < 4+ipv6HeaderSize {
+		return errors.New("invalid packet too big")
+	}
+	mtu := int(binary.BigEndian.Uint32(f.payload[:4]))
+	var src, dst [16]byte
+	copy(src[:], f.payload[4+8:4+24])
+	copy(dst[:], f.payload[4+24:4+40])
+	if !dev.ownsIPv6(src) {
+		return errors.New("packet too big for a packet we did not send")
+	}
+	ipv6PathMTUs.update(dev.vrf(), dst, mtu)
+	fmt.Printf("%sicmp6%s path mtu to %v is %d\n", blue, reset, net.IP(dst[:]), ipv6PathMTUs.lookup(dev.vrf(), dst))
+	return errors.New("do nothing")
+}
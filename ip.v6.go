@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"unsafe"
+)
+
+type ipv6NextHeader uint8
+
+const (
+	ipv6HeaderHopByHop ipv6NextHeader = 0
+	ipv6HeaderTCP      ipv6NextHeader = 6
+	ipv6HeaderUDP      ipv6NextHeader = 17
+	ipv6HeaderRouting  ipv6NextHeader = 43
+	ipv6HeaderFragment ipv6NextHeader = 44
+	ipv6HeaderESP      ipv6NextHeader = 50
+	ipv6HeaderAH       ipv6NextHeader = 51
+	ipv6HeaderICMPv6   ipv6NextHeader = 58
+	ipv6HeaderNoNext   ipv6NextHeader = 59
+	ipv6HeaderDestOpts ipv6NextHeader = 60
+
+	ipv6Version         = 6
+	ipv6HeaderSize      = 40
+	ipv6DefaultHopLimit = 64
+	ipv6MinMTU          = 1280
+)
+
+/*
+
+0               1               2               3               4
+0 1 2 3 4 5 6 7 8 1 2 3 4 5 6 7 8 1 2 3 4 5 6 7 8 1 2 3 4 5 6 7 8
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|Version| Traffic Class |           Flow Label                  |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|         Payload Length        |  Next Header  |   Hop Limit   |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                     Source Address (128 bits)                 +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                  Destination Address (128 bits)               +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	首部固定 40 字节, 没有校验和, 也不在路由器上分片
+	可选的功能放在扩展首部中, 通过 Next Header 串成一条链, 最后一个是上层协议:
+	Hop-by-Hop Options -> Destination Options -> Routing -> Fragment -> AH -> ... -> 上层协议
+	除了 Fragment (固定 8 字节) 和 AH (单位 4 字节), 扩展首部的第二个字节是以 8 字节为单位的长度 (不含前 8 字节)
+*/
+type ipv6 struct {
+	header struct {
+		Version_TC_FL uint32 // version 4 位, traffic class 8 位, flow label 20 位
+		PayloadLen    uint16 // 首部之后的长度, 包括扩展首部
+		NextHeader    ipv6NextHeader
+		HopLimit      uint8
+		Src           [16]byte
+		Dst           [16]byte
+	}
+	extensions []ipv6Extension // 扩展首部, 按出现的顺序
+	protocol   ipv6NextHeader  // 上层协议, 没有上层协议时为 ipv6HeaderNoNext, 分片时是 Fragment 首部的 Next Header
+	payload    []byte          // 上层协议的数据
+}
+
+type ipv6Extension struct {
+	kind   ipv6NextHeader
+	offset int    // 在数据报中的偏移, 回复 parameter problem 时使用
+	data   []byte // 完整的扩展首部, 第一个字节是下一个首部的类型
+}
+
+func isIPv6Extension(kind ipv6NextHeader) bool {
+	switch kind {
+	case ipv6HeaderHopByHop, ipv6HeaderRouting, ipv6HeaderFragment, ipv6HeaderAH, ipv6HeaderDestOpts:
+		return true
+	}
+	return false
+}
+
+func (f *ipv6) decode(data []byte) error {
+	if len(data) < int(unsafe.Sizeof(f.header)) {
+		return fmt.Errorf("ipv6 packet is too short (%d)", len(data))
+	}
+	buf := bytes.NewBuffer(data)
+	if err := binary.Read(buf, binary.BigEndian, &f.header); err != nil {
+		return err
+	}
+	if f.header.Version_TC_FL>>28 != ipv6Version {
+		return fmt.Errorf("not ipv6 packet")
+	}
+	end := ipv6HeaderSize + int(f.header.PayloadLen)
+	if len(data) < end {
+		return fmt.Errorf("ipv6 packet length error")
+	}
+	if f.header.HopLimit == 0 {
+		return fmt.Errorf("ipv6 packet was dead (hop limit=0)")
+	}
+	f.extensions = f.extensions[:0]
+	next, offset := f.header.NextHeader, ipv6HeaderSize
+	pointer := 6 // 指向当前首部类型的 Next Header 字段, 固定首部中它的偏移是 6
+	for isIPv6Extension(next) {
+		if next == ipv6HeaderHopByHop && offset != ipv6HeaderSize {
+			return &ipv6ParameterProblemError{code: icmpv6CodeUnrecognizedNext, pointer: pointer, reason: "hop-by-hop options must follow the ipv6 header"}
+		}
+		if offset+8 > end {
+			return fmt.Errorf("truncated ipv6 extension header %d", next)
+		}
+		var size int
+		switch next {
+		case ipv6HeaderFragment:
+			size = 8
+		case ipv6HeaderAH:
+			size = (int(data[offset+1]) + 2) * 4
+		default:
+			size = (int(data[offset+1]) + 1) * 8
+		}
+		if offset+size > end {
+			return fmt.Errorf("truncated ipv6 extension header %d", next)
+		}
+		f.extensions = append(f.extensions, ipv6Extension{kind: next, offset: offset, data: data[offset : offset+size]})
+		fragment := next == ipv6HeaderFragment
+		next, pointer, offset = ipv6NextHeader(data[offset]), offset, offset+size
+		if fragment {
+			break // 之后是可分片部分, 重组之后再解析
+		}
+	}
+	f.protocol = next
+	f.payload = data[offset:end]
+	return nil
+}
+
+// PayloadLen 和各个首部的 Next Header 根据 extensions, protocol 和 payload 重新计算
+func (f *ipv6) encode() []byte {
+	length := len(f.payload)
+	for _, ext := range f.extensions {
+		length += len(ext.data)
+	}
+	f.header.Version_TC_FL = f.header.Version_TC_FL&0x0fffffff | ipv6Version<<28
+	f.header.PayloadLen = uint16(length)
+	f.header.NextHeader = f.protocol
+	if len(f.extensions) > 0 {
+		f.header.NextHeader = f.extensions[0].kind
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &f.header)
+	for i, ext := range f.extensions {
+		next := f.protocol
+		if i+1 < len(f.extensions) {
+			next = f.extensions[i+1].kind
+		}
+		buf.WriteByte(byte(next))
+		buf.Write(ext.data[1:])
+	}
+	buf.Write(f.payload)
+	return buf.Bytes()
+}
+
+func (f *ipv6) pseudoHeader(protocol uint8, length int) []byte {
+	b := make([]byte, 40)
+	copy(b[0:16], f.header.Src[:])
+	copy(b[16:32], f.header.Dst[:])
+	binary.BigEndian.PutUint32(b[32:36], uint32(length))
+	b[39] = protocol
+	return b
+}
+
+func (f *ipv6) upperPayload() []byte {
+	return f.payload
+}
+
+func (f *ipv6) setUpperPayload(payload []byte) {
+	f.payload = payload
+}
+
+func (f *ipv6) swapAddresses() {
+	f.header.Src, f.header.Dst = f.header.Dst, f.header.Src
+}
+
+func (f ipv6) handle(dev *device, upper *eth) (err error) {
+	if err = f.decode(upper.payload); err != nil {
+		log.Println(err)
+		if problem, ok := err.(*ipv6ParameterProblemError); ok && dev.acceptsIPv6(f.header.Dst) {
+			dev.sendIcmpv6ErrorQuote(&f, upper.payload, icmpv6TypeParameterProblem, problem.code, uint32(problem.pointer))
+		}
+		return
+	}
+	fmt.Printf("%s ip6 %s src: %v dst: %v type: %d\n",
+		yellow, reset,
+		net.IP(f.header.Src[:]), net.IP(f.header.Dst[:]), f.protocol)
+
+	if ipv6IsMulticast(f.header.Src) {
+		return errors.New("multicast source address")
+	}
+	multicast := ipv6IsMulticast(f.header.Dst)
+	if !dev.acceptsIPv6(f.header.Dst) {
+		return errors.New("Not us")
+	}
+	if err = f.processExtensions(dev); err != nil {
+		if problem, ok := err.(*ipv6ParameterProblemError); ok {
+			dev.sendIcmpv6Error(&f, icmpv6TypeParameterProblem, problem.code, uint32(problem.pointer))
+		}
+		return
+	}
+	switch f.protocol {
+	case ipv6HeaderICMPv6:
+		err = (icmpv6{}).handle(dev, &f)
+	case ipv6HeaderTCP:
+		if multicast {
+			return errors.New("tcp to multicast address")
+		}
+		err = (tcp{}).handle(dev, &f)
+	case ipv6HeaderUDP:
+		err = (udp{}).handleIPv6(dev, &f)
+	case ipv6HeaderNoNext:
+		return errors.New("no next header")
+	default:
+		// 无法识别的上层协议, pointer 指向包含该值的 Next Header 字段
+		pointer := 6
+		if n := len(f.extensions); n > 0 {
+			pointer = f.extensions[n-1].offset
+		}
+		dev.sendIcmpv6Error(&f, icmpv6TypeParameterProblem, icmpv6CodeUnrecognizedNext, uint32(pointer))
+		return fmt.Errorf("unrecognized next header %d", f.protocol)
+	}
+	if err == nil {
+		fmt.Printf("%s ip6+%s src: %v dst: %v type: %d\n",
+			yellow, reset,
+			net.IP(f.header.Src[:]), net.IP(f.header.Dst[:]), f.protocol)
+
+		f.extensions = nil // 回复不携带请求中的扩展首部
+		f.header.HopLimit = ipv6DefaultHopLimit
+		if multicast {
+			f.header.Src = dev.selectSourceIPv6(f.header.Dst)
+		}
+		upper.payload = f.encode()
+		upper.header.Dst = upper.header.Src
+		if len(upper.payload) > dev.ipv6MTU() { // 请求是重组得到的, 回复也需要分片
+			if err = dev.transmitIPv6(&f, upper.header.Dst); err == nil {
+				err = errors.New("reply fragmented")
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	icmpv6CodeNoRoute            = 0 // 目标不可达: 没有路由
+	icmpv6CodeAdminProhibited    = 1 // 目标不可达: 被管理策略禁止
+	icmpv6CodeAddressUnreachable = 3 // 目标不可达: 邻居解析失败
+	icmpv6CodePortUnreachable    = 4 // 目标不可达: 端口没有监听
+
+	icmpv6CodeHopLimitExceeded   = 0 // 传输过程中 hop limit 超时
+	icmpv6CodeReassemblyExceeded = 1 // 分片重组超时
+
+	icmpv6CodeErroneousHeader    = 0 // parameter problem: 首部字段错误
+	icmpv6CodeUnrecognizedNext   = 1 // parameter problem: 无法识别的 Next Header
+	icmpv6CodeUnrecognizedOption = 2 // parameter problem: 无法识别的选项
+
+	// 差错报文 (包括 ipv6 首部) 不能超过最小 MTU, 引用的原始数据报会被截断
+	icmpv6ErrorQuoteMax = ipv6MinMTU - ipv6HeaderSize - 8
+)
+
+// 类型小于 128 的是差错报文, 其余是信息报文
+func isIcmpv6ErrorType(t icmpv6Type) bool {
+	return t < 128
+}
+
+/*
+	RFC 4443 2.4 (e) 规定了不能回复差错报文的情况:
+	- 原数据报本身是 ICMPv6 差错报文或者重定向
+	- 原数据报发往组播地址, 除非是 Packet Too Big 或者 code 为 2 的 Parameter Problem
+	- 原数据报的源地址不是唯一的单播地址
+*/
+func icmpv6ErrorAllowed(original *ipv6, typ icmpv6Type, code uint8) bool {
+	if original.protocol == ipv6HeaderICMPv6 && len(original.payload) > 0 {
+		t := icmpv6Type(original.payload[0])
+		if isIcmpv6ErrorType(t) || t == icmpv6TypeRedirect {
+			return false
+		}
+	}
+	if ipv6IsMulticast(original.header.Dst) &&
+		typ != icmpv6TypePacketTooBig && !(typ == icmpv6TypeParameterProblem && code == icmpv6CodeUnrecognizedOption) {
+		return false
+	}
+	src := original.header.Src
+	return src != ipv6Unspecified && !ipv6IsMulticast(src)
+}
+
+// 针对 original 向其源地址发送一个 ICMPv6 差错报文, rest 是 icmp 首部之后的 4 个字节
+func (dev *device) sendIcmpv6Error(original *ipv6, typ icmpv6Type, code uint8, rest uint32) error {
+	return dev.sendIcmpv6ErrorQuote(original, nil, typ, code, rest)
+}
+
+// 同 sendIcmpv6Error, quote 不为 nil 时引用它 (收到的原始字节) 而不是重新 encode 的 original
+func (dev *device) sendIcmpv6ErrorQuote(original *ipv6, quote []byte, typ icmpv6Type, code uint8, rest uint32) error {
+	if !icmpv6ErrorAllowed(original, typ, code) {
+		return errors.New("icmpv6 error not allowed")
+	}
+	if dev.ownsIPv6(original.header.Src) { // 本机发出的数据报
+		return errors.New("icmpv6 error to ourselves")
+	}
+	if !icmpLimiter.allow(dev.vrf(), original.header.Src) {
+		return errors.New("icmpv6 error rate limited")
+	}
+	if quote == nil {
+		quote = original.encode()
+	}
+	if len(quote) > icmpv6ErrorQuoteMax {
+		quote = quote[:icmpv6ErrorQuoteMax]
+	}
+	var ip ipv6
+	ip.protocol = ipv6HeaderICMPv6
+	ip.header.Dst = original.header.Src
+	if dev.ownsIPv6(original.header.Dst) { // 原数据报发给本机的单播地址时, 用该地址回复
+		ip.header.Src = original.header.Dst
+	} else {
+		ip.header.Src = dev.selectSourceIPv6(ip.header.Dst)
+	}
+	var msg icmpv6
+	msg.header.Type = typ
+	msg.header.Code = code
+	msg.payload = make([]byte, 4+len(quote))
+	binary.BigEndian.PutUint32(msg.payload[:4], rest)
+	copy(msg.payload[4:], quote)
+	ip.payload = msg.encode(&ip)
+	return dev.vrf().sendIPv6(&ip, dev)
+}
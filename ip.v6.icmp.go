@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+type icmpv6Type uint8
+
+const (
+	icmpv6TypeDestUnreachable  icmpv6Type = 1
+	icmpv6TypePacketTooBig     icmpv6Type = 2
+	icmpv6TypeTimeExceeded     icmpv6Type = 3
+	icmpv6TypeParameterProblem icmpv6Type = 4
+	icmpv6TypeEchoRequest      icmpv6Type = 128
+	icmpv6TypeEchoReply        icmpv6Type = 129
+	icmpv6TypeRouterSolicit    icmpv6Type = 133
+	icmpv6TypeRouterAdvert     icmpv6Type = 134
+	icmpv6TypeNeighborSolicit  icmpv6Type = 135
+	icmpv6TypeNeighborAdvert   icmpv6Type = 136
+	icmpv6TypeRedirect         icmpv6Type = 137
+)
+
+/*
+	ICMPv6, 格式与 ICMPv4 相同, 但是校验和包括 ipv6 伪首部
+	除了差错报文和 echo, 邻居发现 (NDP) 和组播监听发现 (MLD) 也使用 ICMPv6
+*/
+type icmpv6 struct {
+	header struct {
+		Type     icmpv6Type
+		Code     uint8
+		CheckSum uint16
+	}
+	payload []byte
+}
+
+func (f *icmpv6) decode(upper ipPacket) error {
+	data := upper.upperPayload()
+	if len(data) < 4 {
+		return fmt.Errorf("icmpv6 message is too short")
+	}
+	if sum := transportCheckSum(upper, uint8(ipv6HeaderICMPv6), data); sum != 0 {
+		return fmt.Errorf("icmpv6 checksum error (%x)", sum)
+	}
+	buf := bytes.NewBuffer(data)
+	if err := binary.Read(buf, binary.BigEndian, &f.header); err != nil {
+		return err
+	}
+	f.payload = buf.Bytes()
+	return nil
+}
+
+// upper 的地址需要先填好, 校验和依赖它们
+func (f *icmpv6) encode(upper ipPacket) []byte {
+	buf := make([]byte, 4+len(f.payload))
+	buf[0] = uint8(f.header.Type)
+	buf[1] = f.header.Code
+	copy(buf[4:], f.payload)
+	binary.BigEndian.PutUint16(buf[2:4], transportCheckSum(upper, uint8(ipv6HeaderICMPv6), buf))
+	return buf
+}
+
+/*
+	echo request 在原数据报上回复, 由各个处理函数自己设置回复的地址
+	NDP 报文的回复需要 hop limit 255, 由处理函数主动发送
+*/
+func (f icmpv6) handle(dev *device, upper *ipv6) (err error) {
+	if err = f.decode(upper); err != nil {
+		return err
+	}
+	fmt.Printf("%sicmp6%s type %d code %d\n", blue, reset, f.header.Type, f.header.Code)
+	switch f.header.Type {
+	case icmpv6TypeEchoRequest:
+		err = f.echo(dev, upper)
+	case icmpv6TypeNeighborSolicit:
+		err = dev.handleNeighborSolicit(upper, &f)
+	case icmpv6TypeNeighborAdvert:
+		err = dev.handleNeighborAdvert(upper, &f)
+	case icmpv6TypeRouterAdvert:
+		err = dev.handleRouterAdvert(upper, &f)
+	case icmpv6TypeRedirect:
+		err = dev.handleRedirect(upper, &f)
+	case icmpv6TypePacketTooBig:
+		err = dev.handlePacketTooBig(&f)
+	case icmpv6TypeMLDQuery, icmpv6TypeMLDReport:
+		err = dev.handleMLD(upper, &f)
+	case icmpv6TypeMLDDone, icmpv6TypeMLDv2Report: // 只有路由器关心
+		err = errors.New("do nothing")
+	case icmpv6TypeRouterSolicit: // 主机不处理路由器请求
+		err = errors.New("do nothing")
+	default:
+		if isIcmpv6ErrorType(f.header.Type) {
+			log.Printf("icmp6 error type %d code %d from %v", f.header.Type, f.header.Code, net.IP(upper.header.Src[:]))
+			err = errors.New("do nothing")
+		} else { // 无法识别的信息报文, 静默丢弃 (RFC 4443 2.4 b)
+			err = fmt.Errorf("unknown icmpv6 type %d", f.header.Type)
+		}
+	}
+	if err == nil {
+		upper.payload = f.encode(upper)
+	}
+	return
+}
+
+// 发往组播地址的 echo request 用出口设备选择的地址回复, 校验和依赖源地址, 所以在这里就要选好
+func (f *icmpv6) echo(dev *device, upper *ipv6) error {
+	f.header.Type = icmpv6TypeEchoReply
+	upper.swapAddresses()
+	if ipv6IsMulticast(upper.header.Src) {
+		upper.header.Src = dev.selectSourceIPv6(upper.header.Dst)
+		if upper.header.Src == ipv6Unspecified {
+			return errors.New("no usable address")
+		}
+	}
+	return nil
+}
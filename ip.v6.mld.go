@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	MLD (Multicast Listener Discovery), ipv6 中对应 IGMP 的协议, 报文是 ICMPv6
+
+	v1 报文 (查询, 报告, Done):
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|     Type      |     Code      |          Checksum             |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|     Maximum Response Delay    |          Reserved             |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|                 Multicast Address (128 bits)                  |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	v2 查询在此之后还有 Resv|S|QRV, QQIC, 源地址个数和源地址列表
+	v2 报告的第二个 32 位是 Reserved + 组记录个数, 之后是若干组记录:
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|  Record Type  |  Aux Data Len |     Number of Sources (N)     |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|                 Multicast Address (128 bits)                  |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	与 IGMP 一样默认使用 v2, 收到 v1 查询后在 mldOlderQuerierTimeout 内切换到 v1, 只支持任意源组播
+	MLD 报文的 hop limit 为 1, 带有 Router Alert 选项, 源地址是链路本地地址 (还没有时用 ::)
+	所有节点组 ff02::1 总是加入的且不报告, 每个单播地址的 solicited-node 组随地址加入和离开
+*/
+const (
+	icmpv6TypeMLDQuery    icmpv6Type = 130
+	icmpv6TypeMLDReport   icmpv6Type = 131
+	icmpv6TypeMLDDone     icmpv6Type = 132
+	icmpv6TypeMLDv2Report icmpv6Type = 143
+
+	mldModeIsExclude       = 2
+	mldChangeToInclude     = 3
+	mldChangeToExclude     = 4
+	mldRobustness          = 2
+	mldUnsolicitedDelay    = time.Second
+	mldOlderQuerierTimeout = mldRobustness*125*time.Second + 10*time.Second
+)
+
+var ipv6MLDv2Routers = [16]byte{0xff, 0x02, 15: 0x16}
+
+type mldGroup struct {
+	addr        [16]byte
+	users       int
+	timer       *time.Timer
+	unsolicited []*time.Timer // 加入时待发送的主动报告, 离开时停止
+	deadline    time.Time
+}
+
+type mldState struct {
+	groups  map[[16]byte]*mldGroup
+	v1Until time.Time   // 存在 v1 查询者
+	general *time.Timer // v2 对通用查询的汇总报告
+	mutex   sync.Mutex
+}
+
+func (dev *device) mldState() *mldState {
+	dev.mcastMutex.Lock()
+	defer dev.mcastMutex.Unlock()
+	if dev.mld == nil {
+		dev.mld = &mldState{groups: make(map[[16]byte]*mldGroup)}
+	}
+	return dev.mld
+}
+
+func (st *mldState) versionUnlocked() int {
+	if time.Now().Before(st.v1Until) {
+		return 1
+	}
+	return 2
+}
+
+// 范围小于链路的组 (ff00::/16, ff01::/16) 和所有节点组不需要报告
+func mldReportable(group [16]byte) bool {
+	return group[1]&0x0f > 1 && group != ipv6AllNodes
+}
+
+func (dev *device) inIPv6Group(group [16]byte) bool {
+	if group == ipv6AllNodes {
+		return true
+	}
+	st := dev.mldState()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.groups[group] != nil
+}
+
+func (dev *device) joinIPv6Group(group [16]byte) error {
+	if !ipv6IsMulticast(group) {
+		return errors.New("not a multicast address")
+	}
+	if group == ipv6AllNodes {
+		return nil
+	}
+	st := dev.mldState()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if g := st.groups[group]; g != nil {
+		g.users++
+		return nil
+	}
+	g := &mldGroup{addr: group, users: 1}
+	st.groups[group] = g
+	dev.addMulticastMAC(ipv6MulticastMAC(group))
+	fmt.Printf("%s mld %s %s join %v\n", magenta, reset, dev.name, net.IP(group[:]))
+	if !mldReportable(group) {
+		return nil
+	}
+	version := st.versionUnlocked()
+	for i := 0; i < mldRobustness; i++ {
+		g.unsolicited = append(g.unsolicited, time.AfterFunc(time.Duration(i)*mldUnsolicitedDelay, func() {
+			st.mutex.Lock()
+			member := st.groups[group] == g
+			st.mutex.Unlock()
+			if member { // 发送前已经离开 (或者离开后又重新加入) 时不再发送
+				dev.sendMLDReport(version, group, mldChangeToExclude)
+			}
+		}))
+	}
+	return nil
+}
+
+func (dev *device) leaveIPv6Group(group [16]byte) error {
+	if group == ipv6AllNodes {
+		return nil
+	}
+	st := dev.mldState()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	g := st.groups[group]
+	if g == nil {
+		return errors.New("not a member")
+	}
+	if g.users--; g.users > 0 {
+		return nil
+	}
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	for _, t := range g.unsolicited {
+		t.Stop()
+	}
+	delete(st.groups, group)
+	dev.delMulticastMAC(ipv6MulticastMAC(group))
+	fmt.Printf("%s mld %s %s leave %v\n", magenta, reset, dev.name, net.IP(group[:]))
+	if !mldReportable(group) {
+		return nil
+	}
+	if version := st.versionUnlocked(); version == 1 {
+		dev.sendMLD(ipv6AllRouters, icmpv6TypeMLDDone, group, nil)
+	} else {
+		dev.sendMLDReport(version, group, mldChangeToInclude)
+	}
+	return nil
+}
+
+func (dev *device) sendMLDReport(version int, group [16]byte, recordType uint8) error {
+	if version == 1 {
+		return dev.sendMLD(group, icmpv6TypeMLDReport, group, nil)
+	}
+	return dev.sendMLDv2Report(recordType, [][16]byte{group})
+}
+
+func (dev *device) sendMLDv2Report(recordType uint8, groups [][16]byte) error {
+	payload := make([]byte, 4, 4+20*len(groups))
+	binary.BigEndian.PutUint16(payload[2:4], uint16(len(groups)))
+	for _, group := range groups {
+		payload = append(payload, recordType, 0, 0, 0)
+		payload = append(payload, group[:]...)
+	}
+	return dev.sendMLD(ipv6MLDv2Routers, icmpv6TypeMLDv2Report, [16]byte{}, payload)
+}
+
+/*
+	发送 MLD 报文, payload 为空时是 v1 格式: Maximum Response Delay + Reserved + group
+	v2 报告的 payload 由调用者构造
+*/
+func (dev *device) sendMLD(dst [16]byte, typ icmpv6Type, group [16]byte, payload []byte) error {
+	var ip ipv6
+	ip.protocol = ipv6HeaderICMPv6
+	ip.header.HopLimit = 1
+	ip.header.Src = dev.linkLocalIPv6()
+	ip.header.Dst = dst
+	// Router Alert (value 0 表示 MLD) 加上 2 字节的 PadN 补齐到 8 字节
+	ip.extensions = []ipv6Extension{{kind: ipv6HeaderHopByHop, data: []byte{0, 0, ipv6OptionRouterAlert, 2, 0, 0, ipv6OptionPadN, 0}}}
+	var msg icmpv6
+	msg.header.Type = typ
+	msg.payload = payload
+	if payload == nil {
+		msg.payload = append(make([]byte, 4), group[:]...)
+	}
+	ip.payload = msg.encode(&ip)
+	return dev.transmitIPv6(&ip, ipv6MulticastMAC(dst))
+}
+
+// 可用的链路本地地址, 没有时返回 ::
+func (dev *device) linkLocalIPv6() [16]byte {
+	for _, a := range dev.ipv6Addresses() {
+		if ipv6IsLinkLocal(a.addr) && a.usable() {
+			return a.addr
+		}
+	}
+	return ipv6Unspecified
+}
+
+// v2 的 Maximum Response Code 大于等于 32768 时是浮点数表示: 1|exp(3)|mant(12), 单位毫秒
+func mldMaxResp(code uint16) time.Duration {
+	value := int(code)
+	if code >= 0x8000 {
+		value = int(code&0x0fff|0x1000) << (int(code>>12&0x07) + 3)
+	}
+	return time.Duration(value) * time.Millisecond
+}
+
+/*
+	处理查询和其它主机的报告
+	MLD 报文必须来自链路本地地址并且 hop limit 为 1, 否则可能来自其它链路
+*/
+func (dev *device) handleMLD(upper *ipv6, f *icmpv6) error {
+	if upper.header.HopLimit != 1 || !ipv6IsLinkLocal(upper.header.Src) || len(f.payload) < 20 {
+		return errors.New("invalid mld message")
+	}
+	var group [16]byte
+	copy(group[:], f.payload[4:20])
+	fmt.Printf("%s mld %s type %d group %v\n", magenta, reset, f.header.Type, net.IP(group[:]))
+	st := dev.mldState()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	switch f.header.Type {
+	case icmpv6TypeMLDQuery:
+		var maxResp time.Duration
+		switch {
+		case len(f.payload) == 20: // v1 查询
+			st.v1Until = time.Now().Add(mldOlderQuerierTimeout)
+			maxResp = time.Duration(binary.BigEndian.Uint16(f.payload[:2])) * time.Millisecond
+		case len(f.payload) >= 24:
+			maxResp = mldMaxResp(binary.BigEndian.Uint16(f.payload[:2]))
+		default:
+			return errors.New("invalid mld query")
+		}
+		if maxResp == 0 {
+			maxResp = 100 * time.Millisecond
+		}
+		version := st.versionUnlocked()
+		if group == ipv6Unspecified && version == 2 {
+			dev.scheduleMLDGeneralReportUnlocked(st, maxResp)
+			return errors.New("do nothing")
+		}
+		for _, g := range st.groups {
+			if mldReportable(g.addr) && (group == ipv6Unspecified || group == g.addr) {
+				dev.scheduleMLDReportUnlocked(st, g, maxResp)
+			}
+		}
+	case icmpv6TypeMLDReport:
+		// v1 中同一链路上有一个节点报告过就够了, 取消自己待发送的报告
+		if g := st.groups[group]; g != nil && g.timer != nil && st.versionUnlocked() == 1 {
+			g.timer.Stop()
+			g.timer = nil
+		}
+	}
+	return errors.New("do nothing")
+}
+
+func (dev *device) scheduleMLDReportUnlocked(st *mldState, g *mldGroup, maxResp time.Duration) {
+	delay := time.Duration(rand.Int63n(int64(maxResp)))
+	deadline := time.Now().Add(delay)
+	if g.timer != nil && g.deadline.Before(deadline) {
+		return
+	}
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	g.deadline = deadline
+	g.timer = time.AfterFunc(delay, func() {
+		st.mutex.Lock()
+		if st.groups[g.addr] != g {
+			st.mutex.Unlock()
+			return
+		}
+		g.timer = nil
+		version := st.versionUnlocked()
+		st.mutex.Unlock()
+		dev.sendMLDReport(version, g.addr, mldModeIsExclude)
+	})
+}
+
+func (dev *device) scheduleMLDGeneralReportUnlocked(st *mldState, maxResp time.Duration) {
+	if st.general != nil {
+		return
+	}
+	st.general = time.AfterFunc(time.Duration(rand.Int63n(int64(maxResp))), func() {
+		st.mutex.Lock()
+		st.general = nil
+		groups := make([][16]byte, 0, len(st.groups))
+		for addr := range st.groups {
+			if mldReportable(addr) {
+				groups = append(groups, addr)
+			}
+		}
+		st.mutex.Unlock()
+		if len(groups) > 0 {
+			dev.sendMLDv2Report(mldModeIsExclude, groups)
+		}
+	})
+}
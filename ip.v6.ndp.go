@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	邻居发现 (NDP, RFC 4861), 承担了 ipv4 中 ARP, ICMP 路由器发现和重定向的工作
+	- NS/NA: 解析邻居的链路层地址, 以及重复地址检测 (DAD)
+	- RS/RA: 主机启动时请求路由器通告, 从通告中学习默认路由器
+	- Redirect: 路由器告诉主机到某个目的地址有更好的下一跳
+	所有 NDP 报文的 hop limit 必须是 255, 这样可以保证报文来自同一条链路
+*/
+const (
+	ndpHopLimit = 255
+
+	ndpOptionSourceLinkAddr = 1
+	ndpOptionTargetLinkAddr = 2
+	ndpOptionPrefixInfo     = 3
+	ndpOptionRedirected     = 4
+	ndpOptionMTU            = 5
+
+	ndpFlagRouter    = 0x80 // NA: 发送方是路由器
+	ndpFlagSolicited = 0x40 // NA: 是对 NS 的回复
+	ndpFlagOverride  = 0x20 // NA: 覆盖已有的链路层地址
+
+	ndpMaxRtrSolicitations     = 3
+	ndpRtrSolicitationInterval = 4 * time.Second
+	ndpMaxRtrSolicitationDelay = time.Second
+	ndpDefaultRouterMetric     = 1024
+)
+
+// NDP 选项: Type(8) Length(8, 单位 8 字节) 之后是 data
+type ndpOption struct {
+	kind uint8
+	data []byte
+}
+
+func parseNdpOptions(b []byte) ([]ndpOption, error) {
+	var opts []ndpOption
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] == 0 || int(b[1])*8 > len(b) {
+			return nil, errors.New("invalid ndp option")
+		}
+		size := int(b[1]) * 8
+		opts = append(opts, ndpOption{kind: b[0], data: b[2:size]})
+		b = b[size:]
+	}
+	return opts, nil
+}
+
+func findNdpOption(opts []ndpOption, kind uint8) *ndpOption {
+	for i := range opts {
+		if opts[i].kind == kind {
+			return &opts[i]
+		}
+	}
+	return nil
+}
+
+// 链路层地址选项中的 mac
+func (opt *ndpOption) linkAddr() ([6]byte, bool) {
+	var mac [6]byte
+	if opt == nil || len(opt.data) < 6 {
+		return mac, false
+	}
+	copy(mac[:], opt.data)
+	return mac, true
+}
+
+func ndpLinkAddrOption(kind uint8, mac [6]byte) []byte {
+	return append([]byte{kind, 1}, mac[:]...)
+}
+
+// NDP 报文的公共检查, minLen 是 icmp 首部之后的最小长度
+func (f *icmpv6) validNdp(upper *ipv6, minLen int) bool {
+	return upper.header.HopLimit == ndpHopLimit && f.header.Code == 0 && len(f.payload) >= minLen
+}
+
+/*
+	发送 NS
+	dad 为真时是重复地址检测: 源地址为 ::, 不带源链路层地址选项
+	否则是地址解析: 发往目标的 solicited-node 组播地址
+*/
+func (dev *device) sendNeighborSolicit(target [16]byte, dad bool) error {
+	var ip ipv6
+	ip.protocol = ipv6HeaderICMPv6
+	ip.header.HopLimit = ndpHopLimit
+	ip.header.Dst = ipv6SolicitedNode(target)
+	if !dad {
+		ip.header.Src = dev.selectSourceIPv6(target)
+	}
+	var msg icmpv6
+	msg.header.Type = icmpv6TypeNeighborSolicit
+	msg.payload = make([]byte, 4, 28)
+	msg.payload = append(msg.payload, target[:]...)
+	if ip.header.Src != ipv6Unspecified {
+		msg.payload = append(msg.payload, ndpLinkAddrOption(ndpOptionSourceLinkAddr, dev.hardwareAddr)...)
+	}
+	ip.payload = msg.encode(&ip)
+	return dev.transmitIPv6(&ip, ipv6MulticastMAC(ip.header.Dst))
+}
+
+func (dev *device) sendNeighborAdvert(dst, target [16]byte, flags uint8) error {
+	var ip ipv6
+	ip.protocol = ipv6HeaderICMPv6
+	ip.header.HopLimit = ndpHopLimit
+	ip.header.Src = target
+	ip.header.Dst = dst
+	var msg icmpv6
+	msg.header.Type = icmpv6TypeNeighborAdvert
+	msg.payload = make([]byte, 4, 28)
+	msg.payload[0] = flags
+	msg.payload = append(msg.payload, target[:]...)
+	msg.payload = append(msg.payload, ndpLinkAddrOption(ndpOptionTargetLinkAddr, dev.hardwareAddr)...)
+	ip.payload = msg.encode(&ip)
+	return dev.vrf().sendIPv6(&ip, dev)
+}
+
+/*
+	NS: Reserved(32) Target Address(128) Options
+	源地址为 :: 时是别人在对 target 做 DAD
+*/
+func (dev *device) handleNeighborSolicit(upper *ipv6, f *icmpv6) error {
+	if !f.validNdp(upper, 20) {
+		return errors.New("invalid neighbor solicitation")
+	}
+	var target [16]byte
+	copy(target[:], f.payload[4:20])
+	opts, err := parseNdpOptions(f.payload[20:])
+	if err != nil || ipv6IsMulticast(target) {
+		return errors.New("invalid neighbor solicitation")
+	}
+	src := upper.header.Src
+	slla, hasSlla := findNdpOption(opts, ndpOptionSourceLinkAddr).linkAddr()
+	if src == ipv6Unspecified && (hasSlla || upper.header.Dst != ipv6SolicitedNode(target)) {
+		return errors.New("invalid dad neighbor solicitation")
+	}
+	state, ok := dev.ipv6AddressState(target)
+	if !ok {
+		return errors.New("NS was not for us")
+	}
+	if state == ipv6AddrTentative {
+		if src == ipv6Unspecified { // 别人也在检测同一个地址
+			dev.dadFailed(target)
+		}
+		return errors.New("target is tentative")
+	}
+	// NA 需要 hop limit 255, 不能在原数据报上原地回复
+	if src == ipv6Unspecified { // 对 DAD 的回复发给所有节点
+		err = dev.sendNeighborAdvert(ipv6AllNodes, target, ndpFlagOverride)
+	} else {
+		v := dev.vrf()
+		if hasSlla {
+			v.ndp.learn(dev, src, slla, true)
+			v.pending6.resolved(dev, src)
+		}
+		err = dev.sendNeighborAdvert(src, target, ndpFlagSolicited|ndpFlagOverride)
+	}
+	if err != nil {
+		return err
+	}
+	return errors.New("do nothing")
+}
+
+// NA: R|S|O|Reserved(29) Target Address(128) Options
+func (dev *device) handleNeighborAdvert(upper *ipv6, f *icmpv6) error {
+	if !f.validNdp(upper, 20) {
+		return errors.New("invalid neighbor advertisement")
+	}
+	flags := f.payload[0]
+	var target [16]byte
+	copy(target[:], f.payload[4:20])
+	opts, err := parseNdpOptions(f.payload[20:])
+	if err != nil || ipv6IsMulticast(target) ||
+		ipv6IsMulticast(upper.header.Dst) && flags&ndpFlagSolicited != 0 {
+		return errors.New("invalid neighbor advertisement")
+	}
+	if state, ok := dev.ipv6AddressState(target); ok {
+		if state == ipv6AddrTentative {
+			dev.dadFailed(target)
+		} else {
+			log.Printf("%s: duplicate address %v detected", dev.name, net.IP(target[:]))
+		}
+		return errors.New("NA for our address")
+	}
+	v := dev.vrf()
+	tlla, hasTlla := findNdpOption(opts, ndpOptionTargetLinkAddr).linkAddr()
+	entry := v.ndp.lookup(dev, target)
+	switch {
+	case entry == nil && hasTlla && v.pending6.isPending(dev, target):
+		v.ndp.insert(dev, target, tlla)
+	case entry != nil && hasTlla:
+		v.ndp.update(dev, target, tlla, flags&ndpFlagOverride != 0)
+	case entry == nil:
+		return errors.New("unsolicited neighbor advertisement")
+	}
+	isRouter := flags&ndpFlagRouter != 0
+	if entry != nil && entry.isRouter && !isRouter { // 路由器变成了主机
+		ipv6DefaultRouters.remove(dev, target)
+	}
+	v.ndp.setRouter(dev, target, isRouter)
+	v.pending6.resolved(dev, target)
+	return errors.New("do nothing")
+}
+
+/*
+	RA: Cur Hop Limit(8) M|O|Reserved(8) Router Lifetime(16) Reachable Time(32) Retrans Timer(32) Options
+	Router Lifetime 不为 0 时, 发送方可以作为默认路由器
+	前缀和 MTU 选项用于地址自动配置, 见 ip.v6.slaac.go
+*/
+func (dev *device) handleRouterAdvert(upper *ipv6, f *icmpv6) error {
+	if !f.validNdp(upper, 12) || !ipv6IsLinkLocal(upper.header.Src) {
+		return errors.New("invalid router advertisement")
+	}
+	opts, err := parseNdpOptions(f.payload[12:])
+	if err != nil {
+		return err
+	}
+	src := upper.header.Src
+	v := dev.vrf()
+	if slla, ok := findNdpOption(opts, ndpOptionSourceLinkAddr).linkAddr(); ok {
+		v.ndp.learn(dev, src, slla, true)
+		v.pending6.resolved(dev, src)
+	}
+	v.ndp.setRouter(dev, src, true)
+	lifetime := time.Duration(uint16(f.payload[2])<<8|uint16(f.payload[3])) * time.Second
+	ipv6DefaultRouters.update(dev, src, lifetime)
+	for _, opt := range opts {
+		switch opt.kind {
+		case ndpOptionPrefixInfo:
+			dev.handlePrefixInfo(opt.data)
+		case ndpOptionMTU:
+			dev.handleMTUOption(opt.data)
+		}
+	}
+	dev.routerAdvertised()
+	return errors.New("do nothing")
+}
+
+/*
+	Redirect: Reserved(32) Target Address(128) Destination Address(128) Options
+	target 等于 destination 表示目的地址就在链路上, 否则 target 是更好的下一跳路由器
+	只接受当前到达 destination 的第一跳路由器发来的重定向
+*/
+func (dev *device) handleRedirect(upper *ipv6, f *icmpv6) error {
+	if !f.validNdp(upper, 36) || !ipv6IsLinkLocal(upper.header.Src) {
+		return errors.New("invalid redirect")
+	}
+	var target, destination [16]byte
+	copy(target[:], f.payload[4:20])
+	copy(destination[:], f.payload[20:36])
+	opts, err := parseNdpOptions(f.payload[36:])
+	if err != nil || ipv6IsMulticast(destination) || target != destination && !ipv6IsLinkLocal(target) {
+		return errors.New("invalid redirect")
+	}
+	v := dev.vrf()
+	route, nextHop := v.routes6.lookup(destination)
+	if route == nil || route.dev != dev || nextHop != upper.header.Src {
+		return errors.New("redirect not from the current first hop")
+	}
+	host := ipv6Prefix{addr: destination, len: 128}
+	v.routes6.removeIf(func(r *ipv6Route) bool { return r.redirect && r.prefix == host })
+	redirect := &ipv6Route{prefix: host, dev: dev, redirect: true}
+	if target != destination {
+		redirect.gateway = target
+	}
+	v.routes6.add(redirect)
+	if tlla, ok := findNdpOption(opts, ndpOptionTargetLinkAddr).linkAddr(); ok {
+		v.ndp.learn(dev, target, tlla, true)
+		v.pending6.resolved(dev, target)
+	}
+	fmt.Printf("%sicmp6%s redirect %v via %v\n", blue, reset, net.IP(destination[:]), net.IP(target[:]))
+	return errors.New("do nothing")
+}
+
+/*
+	默认路由器列表
+	每个路由器对应 routes6 中的一条默认路由, Router Lifetime 到期后删除
+*/
+type ipv6RouterKey struct {
+	dev  *device
+	addr [16]byte
+}
+
+type ipv6RouterList struct {
+	timers map[ipv6RouterKey]*time.Timer
+	mutex  sync.Mutex
+}
+
+var ipv6DefaultRouters = &ipv6RouterList{timers: make(map[ipv6RouterKey]*time.Timer)}
+
+func (rl *ipv6RouterList) update(dev *device, addr [16]byte, lifetime time.Duration) {
+	if lifetime == 0 {
+		rl.remove(dev, addr)
+		return
+	}
+	key := ipv6RouterKey{dev: dev, addr: addr}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if timer := rl.timers[key]; timer != nil {
+		timer.Reset(lifetime)
+		return
+	}
+	rl.timers[key] = time.AfterFunc(lifetime, func() { rl.remove(dev, addr) })
+	dev.vrf().routes6.add(&ipv6Route{gateway: addr, dev: dev, metric: ndpDefaultRouterMetric})
+	fmt.Printf("%sicmp6%s %s default router %v\n", blue, reset, dev.name, net.IP(addr[:]))
+}
+
+func (rl *ipv6RouterList) remove(dev *device, addr [16]byte) {
+	key := ipv6RouterKey{dev: dev, addr: addr}
+	rl.mutex.Lock()
+	timer := rl.timers[key]
+	delete(rl.timers, key)
+	rl.mutex.Unlock()
+	if timer == nil {
+		return
+	}
+	timer.Stop()
+	dev.vrf().routes6.removeIf(func(r *ipv6Route) bool {
+		return r.dev == dev && r.gateway == addr && r.prefix.len == 0 && r.metric == ndpDefaultRouterMetric
+	})
+}
+
+/*
+	设备启动后发送路由器请求, 收到 RA 或者发送 ndpMaxRtrSolicitations 次后停止
+	还没有可用的链路本地地址时用 :: 作为源地址, 此时不能带源链路层地址选项
+*/
+func (dev *device) solicitRouters(sig chan struct{}) {
+	delay := time.Duration(rand.Int63n(int64(ndpMaxRtrSolicitationDelay)))
+	for i := 0; i < ndpMaxRtrSolicitations; i++ {
+		select {
+		case <-sig:
+			return
+		case <-time.After(delay):
+		}
+		if dev.hasRouterAdvert() {
+			return
+		}
+		var ip ipv6
+		ip.protocol = ipv6HeaderICMPv6
+		ip.header.HopLimit = ndpHopLimit
+		ip.header.Dst = ipv6AllRouters
+		ip.header.Src = dev.selectSourceIPv6(ipv6AllRouters)
+		var msg icmpv6
+		msg.header.Type = icmpv6TypeRouterSolicit
+		msg.payload = make([]byte, 4)
+		if ip.header.Src != ipv6Unspecified {
+			msg.payload = append(msg.payload, ndpLinkAddrOption(ndpOptionSourceLinkAddr, dev.hardwareAddr)...)
+		}
+		ip.payload = msg.encode(&ip)
+		dev.transmitIPv6(&ip, ipv6MulticastMAC(ip.header.Dst))
+		delay = ndpRtrSolicitationInterval
+	}
+}
+
+func (dev *device) routerAdvertised() {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	dev.raReceived = true
+}
+
+func (dev *device) hasRouterAdvert() bool {
+	dev.mutex.RLock()
+	defer dev.mutex.RUnlock()
+	return dev.raReceived
+}
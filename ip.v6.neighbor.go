@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	ipv6 邻居缓存, 与 ARP 缓存的作用相同, 保存邻居的链路层地址
+	ipv6 的链路本地地址只在一条链路上有意义, 所以表项按 (设备, 地址) 区分
+	isRouter 由 NA 的 R 标志和 RA 设置, 路由器变成主机时需要删除经过它的默认路由
+	动态表项在 ndpEntryTTL 后老化, 需要时重新通过邻居请求解析
+*/
+const ndpEntryTTL = 60 * time.Second
+
+type ndpEntry struct {
+	dev             *device
+	protocolAddress [16]byte
+	hardwareAddress [6]byte
+	timestamp       time.Time
+	isRouter        bool
+	static          bool
+}
+
+type ndpTable struct {
+	storage []*ndpEntry
+	mutex   sync.RWMutex
+}
+
+var ndpCache = newNdpTable()
+
+func newNdpTable() *ndpTable {
+	return &ndpTable{storage: make([]*ndpEntry, 0, 1024)}
+}
+
+func (tbl *ndpTable) lookupUnlocked(dev *device, protocolAddress [16]byte) *ndpEntry {
+	for _, entry := range tbl.storage {
+		if entry.dev == dev && entry.protocolAddress == protocolAddress {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (tbl *ndpTable) lookup(dev *device, protocolAddress [16]byte) *ndpEntry {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	return tbl.lookupUnlocked(dev, protocolAddress)
+}
+
+// 更新已有的表项, override 为假时不改变已知的链路层地址 (RFC 4861 7.2.5)
+func (tbl *ndpTable) update(dev *device, protocolAddress [16]byte, hardwareAddress [6]byte, override bool) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	entry := tbl.lookupUnlocked(dev, protocolAddress)
+	if entry == nil {
+		return false
+	}
+	if entry.static || entry.hardwareAddress != hardwareAddress && !override {
+		return true
+	}
+	entry.hardwareAddress = hardwareAddress
+	entry.timestamp = time.Now()
+	return true
+}
+
+func (tbl *ndpTable) insert(dev *device, protocolAddress [16]byte, hardwareAddress [6]byte) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	if tbl.lookupUnlocked(dev, protocolAddress) != nil {
+		return false
+	}
+	tbl.storage = append(tbl.storage, &ndpEntry{
+		dev:             dev,
+		protocolAddress: protocolAddress,
+		hardwareAddress: hardwareAddress,
+		timestamp:       time.Now(),
+	})
+	return true
+}
+
+// 学习邻居的链路层地址, 表项不存在时新建
+func (tbl *ndpTable) learn(dev *device, protocolAddress [16]byte, hardwareAddress [6]byte, override bool) {
+	if !tbl.update(dev, protocolAddress, hardwareAddress, override) {
+		tbl.insert(dev, protocolAddress, hardwareAddress)
+	}
+}
+
+func (tbl *ndpTable) setRouter(dev *device, protocolAddress [16]byte, isRouter bool) {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	if entry := tbl.lookupUnlocked(dev, protocolAddress); entry != nil {
+		entry.isRouter = isRouter
+	}
+}
+
+// 添加静态表项, 已存在的同地址表项会被替换
+func (tbl *ndpTable) insertStatic(dev *device, protocolAddress [16]byte, hardwareAddress [6]byte) {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	entry := tbl.lookupUnlocked(dev, protocolAddress)
+	if entry == nil {
+		entry = &ndpEntry{dev: dev, protocolAddress: protocolAddress}
+		tbl.storage = append(tbl.storage, entry)
+	}
+	entry.hardwareAddress = hardwareAddress
+	entry.timestamp = time.Now()
+	entry.static = true
+}
+
+func (tbl *ndpTable) remove(dev *device, protocolAddress [16]byte) bool {
+	return tbl.removeIf(func(entry *ndpEntry) bool {
+		return entry.dev == dev && entry.protocolAddress == protocolAddress
+	}) > 0
+}
+
+// 删除满足条件的表项, 返回删除的个数
+func (tbl *ndpTable) removeIf(cond func(entry *ndpEntry) bool) int {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	kept := tbl.storage[:0]
+	for _, entry := range tbl.storage {
+		if !cond(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	n := len(tbl.storage) - len(kept)
+	for i := len(kept); i < len(tbl.storage); i++ {
+		tbl.storage[i] = nil
+	}
+	tbl.storage = kept
+	return n
+}
+
+// 清空所有动态表项
+func (tbl *ndpTable) flush() int {
+	return tbl.removeIf(func(entry *ndpEntry) bool {
+		return !entry.static
+	})
+}
+
+func (tbl *ndpTable) expire(now time.Time) int {
+	return tbl.removeIf(func(entry *ndpEntry) bool {
+		return !entry.static && now.Sub(entry.timestamp) > ndpEntryTTL
+	})
+}
+
+// 定期老化动态表项, 直到 sig 被关闭
+func (tbl *ndpTable) age(sig chan struct{}) {
+	ticker := time.NewTicker(ndpEntryTTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sig:
+			return
+		case now := <-ticker.C:
+			tbl.expire(now)
+		}
+	}
+}
+
+// 返回表项的快照, 供展示使用
+func (tbl *ndpTable) entries() []ndpEntry {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	list := make([]ndpEntry, 0, len(tbl.storage))
+	for _, entry := range tbl.storage {
+		list = append(list, *entry)
+	}
+	return list
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+	Hop-by-Hop Options 和 Destination Options 扩展首部
+
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|  Next Header  |  Hdr Ext Len  |                               |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+                               +
+	|                            Options                            |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	选项的格式是 type(8) + length(8) + data, Pad1 只有一个字节
+	type 的最高两位规定了不认识该选项时的处理方式:
+	00 跳过, 01 丢弃, 10 丢弃并回复 parameter problem, 11 丢弃, 目的地址不是组播时回复 parameter problem
+*/
+const (
+	ipv6OptionPad1        = 0
+	ipv6OptionPadN        = 1
+	ipv6OptionRouterAlert = 5 // 只出现在 Hop-by-Hop 中, MLD 报文使用
+
+	ipv6OptionActionSkip      = 0x00
+	ipv6OptionActionDiscard   = 0x40
+	ipv6OptionActionICMP      = 0x80
+	ipv6OptionActionICMPUcast = 0xc0
+
+	ipv6RoutingType0 = 0 // RFC 5095 已经废弃, 可以被用来放大流量
+)
+
+// 扩展首部出错时回复 ICMPv6 parameter problem, pointer 是出错的字节在数据报中的偏移
+type ipv6ParameterProblemError struct {
+	code    uint8
+	pointer int
+	reason  string
+}
+
+func (e *ipv6ParameterProblemError) Error() string {
+	return fmt.Sprintf("ipv6 parameter problem (code %d) at %d: %s", e.code, e.pointer, e.reason)
+}
+
+// 静默丢弃, 不回复任何差错报文
+var errIPv6Discard = errors.New("discarded by ipv6 option")
+
+// 逐个检查选项, 返回选项出错或者需要丢弃数据报的原因
+func (f *ipv6) processOptions(ext *ipv6Extension) error {
+	hbh := ext.kind == ipv6HeaderHopByHop
+	for i := 2; i < len(ext.data); {
+		kind := ext.data[i]
+		if kind == ipv6OptionPad1 {
+			i++
+			continue
+		}
+		if i+2 > len(ext.data) || i+2+int(ext.data[i+1]) > len(ext.data) {
+			return &ipv6ParameterProblemError{code: icmpv6CodeErroneousHeader, pointer: ext.offset + i, reason: "truncated option"}
+		}
+		size := 2 + int(ext.data[i+1])
+		switch {
+		case kind == ipv6OptionPadN:
+		case kind == ipv6OptionRouterAlert && hbh:
+		default:
+			if err := f.unknownOption(kind, ext.offset+i); err != nil {
+				return err
+			}
+		}
+		i += size
+	}
+	return nil
+}
+
+func (f *ipv6) unknownOption(kind uint8, pointer int) error {
+	problem := &ipv6ParameterProblemError{code: icmpv6CodeUnrecognizedOption, pointer: pointer, reason: fmt.Sprintf("unrecognized option %#x", kind)}
+	switch kind & 0xc0 {
+	case ipv6OptionActionSkip:
+		return nil
+	case ipv6OptionActionDiscard:
+		return errIPv6Discard
+	case ipv6OptionActionICMP:
+		return problem
+	}
+	if ipv6IsMulticast(f.header.Dst) {
+		return errIPv6Discard
+	}
+	return problem
+}
+
+/*
+	Routing 扩展首部: Next Header(8) Hdr Ext Len(8) Routing Type(8) Segments Left(8) type-specific data
+	本机不支持任何路由类型, Segments Left 为 0 时忽略该首部, 否则回复 parameter problem 指向 Routing Type
+	RH0 按 RFC 5095 同样处理, 不会按照其中的地址列表转发
+*/
+func (f *ipv6) processRouting(ext *ipv6Extension) error {
+	routingType, segmentsLeft := ext.data[2], ext.data[3]
+	if segmentsLeft == 0 {
+		return nil
+	}
+	reason := fmt.Sprintf("unsupported routing type %d", routingType)
+	if routingType == ipv6RoutingType0 {
+		reason = "routing header type 0 is deprecated"
+	}
+	return &ipv6ParameterProblemError{code: icmpv6CodeErroneousHeader, pointer: ext.offset + 2, reason: reason}
+}
+
+/*
+	按顺序处理扩展首部, 遇到 Fragment 首部时把分片交给重组
+	重组完成后 f 被替换为完整的数据报, 并从头重新处理它的扩展首部
+	返回 ipv6ParameterProblemError 时由调用者回复差错报文
+*/
+func (f *ipv6) processExtensions(dev *device) error {
+	for i := 0; i < len(f.extensions); i++ {
+		ext := &f.extensions[i]
+		var err error
+		switch ext.kind {
+		case ipv6HeaderHopByHop, ipv6HeaderDestOpts:
+			err = f.processOptions(ext)
+		case ipv6HeaderRouting:
+			err = f.processRouting(ext)
+		case ipv6HeaderFragment:
+			var whole *ipv6
+			if whole, err = ipv6Fragments.add(dev, f); err != nil {
+				return err
+			}
+			*f = *whole
+			i = -1
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	ipv6 的发送
+	下一跳的 mac 通过邻居请求 (NS) 解析, 与 ARP 一样, 解析期间数据报先挂起
+	NS 发往目标地址的 solicited-node 组播地址 ff02::1:ffXX:XXXX, 而不是广播
+*/
+const (
+	ndpResolveRetries  = 3 // MAX_MULTICAST_SOLICIT
+	ndpResolveInterval = time.Second
+	ndpPendingMax      = 64
+)
+
+var errAddressUnreachable = errors.New("address unreachable")
+
+type ndpPendingKey struct {
+	dev     *device
+	nextHop [16]byte
+}
+
+type ndpPendingEntry struct {
+	key     ndpPendingKey
+	packets []*ipv6
+	retries int
+	timer   *time.Timer
+}
+
+type ndpResolver struct {
+	cache   *ndpTable
+	pending map[ndpPendingKey]*ndpPendingEntry
+	mutex   sync.Mutex
+}
+
+var ndpPendingQueue = newNdpResolver(ndpCache)
+
+func newNdpResolver(cache *ndpTable) *ndpResolver {
+	return &ndpResolver{
+		cache:   cache,
+		pending: make(map[ndpPendingKey]*ndpPendingEntry),
+	}
+}
+
+// 地址的 solicited-node 组播地址 ff02::1:ff00:0/104
+func ipv6SolicitedNode(addr [16]byte) [16]byte {
+	return [16]byte{0xff, 0x02, 11: 0x01, 12: 0xff, 13: addr[13], 14: addr[14], 15: addr[15]}
+}
+
+/*
+	主动发送一个 ipv6 数据报, 由调用者填好 Dst, protocol 和 payload
+	目的地址是链路范围的 (链路本地地址, ff02::/16 组播) 时由 oif 指定设备, 否则由路由表选择, 忽略 oif
+	Src 为空时由出口设备选择源地址
+*/
+func (v *vrf) sendIPv6(f *ipv6, oif *device) error {
+	dev, nextHop := oif, f.header.Dst
+	if !ipv6IsLinkScope(f.header.Dst) {
+		route, hop := v.routes6.lookup(f.header.Dst)
+		if route == nil {
+			return fmt.Errorf("no route to %v", net.IP(f.header.Dst[:]))
+		}
+		dev, nextHop = route.dev, hop
+	} else if oif == nil {
+		return fmt.Errorf("link scope destination %v needs an interface", net.IP(f.header.Dst[:]))
+	}
+	if f.header.Src == ipv6Unspecified {
+		f.header.Src = dev.selectSourceIPv6(f.header.Dst)
+	}
+	if f.header.HopLimit == 0 {
+		f.header.HopLimit = ipv6DefaultHopLimit
+	}
+	if ipv6IsMulticast(f.header.Dst) {
+		return dev.transmitIPv6(f, ipv6MulticastMAC(f.header.Dst))
+	}
+	return dev.outputIPv6(f, nextHop)
+}
+
+// 解析下一跳的 mac 并发送, 缓存命中时直接发送, 否则挂起数据报并返回 nil
+func (dev *device) outputIPv6(f *ipv6, nextHop [16]byte) error {
+	v := dev.vrf()
+	if entry := v.ndp.lookup(dev, nextHop); entry != nil {
+		return dev.transmitIPv6(f, entry.hardwareAddress)
+	}
+	v.pending6.enqueue(dev, nextHop, f)
+	return nil
+}
+
+var errMTUTooSmall = errors.New("mtu too small to fragment")
+
+// 把数据报发送给 mac 为 dst 的下一跳, 超过链路或者路径 MTU 的数据报在源端分片
+func (dev *device) transmitIPv6(f *ipv6, dst [6]byte) error {
+	data := f.encode()
+	mtu := dev.pathMTU6(f.header.Dst)
+	if len(data) <= mtu {
+		return dev.send(dst, ethernetTypeIPv6, data)
+	}
+	frames, err := f.fragment(mtu)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err := dev.send(dst, ethernetTypeIPv6, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ndpResolver) enqueue(dev *device, nextHop [16]byte, f *ipv6) {
+	copied := *f
+	copied.extensions = append([]ipv6Extension(nil), f.extensions...)
+	copied.payload = append([]byte(nil), f.payload...)
+
+	key := ndpPendingKey{dev: dev, nextHop: nextHop}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry := r.pending[key]
+	if entry == nil {
+		entry = &ndpPendingEntry{key: key}
+		r.pending[key] = entry
+		entry.timer = time.AfterFunc(ndpResolveInterval, func() { r.retry(entry) })
+		go dev.sendNeighborSolicit(nextHop, false)
+	}
+	if len(entry.packets) == ndpPendingMax {
+		entry.packets = entry.packets[1:]
+	}
+	entry.packets = append(entry.packets, &copied)
+}
+
+func (r *ndpResolver) retry(entry *ndpPendingEntry) {
+	r.mutex.Lock()
+	if r.pending[entry.key] != entry {
+		r.mutex.Unlock()
+		return
+	}
+	entry.retries++
+	if entry.retries < ndpResolveRetries {
+		entry.timer.Reset(ndpResolveInterval)
+		r.mutex.Unlock()
+		entry.key.dev.sendNeighborSolicit(entry.key.nextHop, false)
+		return
+	}
+	delete(r.pending, entry.key)
+	r.mutex.Unlock()
+	dev := entry.key.dev
+	for _, f := range entry.packets {
+		// 解析失败时回复 address unreachable, 本机发出的数据报会被 icmpv6ErrorAllowed 过滤
+		dev.sendIcmpv6Error(f, icmpv6TypeDestUnreachable, icmpv6CodeAddressUnreachable, 0)
+	}
+}
+
+// 是否正在解析 addr, 只有这种情况下才接受该邻居主动发来的 NA 建立缓存
+func (r *ndpResolver) isPending(dev *device, addr [16]byte) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.pending[ndpPendingKey{dev: dev, nextHop: addr}] != nil
+}
+
+// 学习到邻居的 mac 之后, 发送挂起的数据报
+func (r *ndpResolver) resolved(dev *device, addr [16]byte) {
+	cached := r.cache.lookup(dev, addr)
+	if cached == nil {
+		return
+	}
+	key := ndpPendingKey{dev: dev, nextHop: addr}
+	r.mutex.Lock()
+	entry := r.pending[key]
+	if entry != nil {
+		entry.timer.Stop()
+		delete(r.pending, key)
+	}
+	r.mutex.Unlock()
+	if entry == nil {
+		return
+	}
+	for _, f := range entry.packets {
+		dev.transmitIPv6(f, cached.hardwareAddress)
+	}
+}
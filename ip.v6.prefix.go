@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// ipv6 网段, 如 fd00:1::/64
+type ipv6Prefix struct {
+	addr [16]byte
+	len  uint8
+}
+
+func parseIPv6Prefix(s string) (p ipv6Prefix, err error) {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil || ipnet.IP.To4() != nil {
+		return p, fmt.Errorf("invalid ipv6 prefix %q", s)
+	}
+	ones, _ := ipnet.Mask.Size()
+	copy(p.addr[:], ipnet.IP.To16())
+	p.len = uint8(ones)
+	return p, nil
+}
+
+func (p ipv6Prefix) contains(addr [16]byte) bool {
+	return maskIPv6(addr, p.len) == maskIPv6(p.addr, p.len)
+}
+
+func (p ipv6Prefix) String() string {
+	return fmt.Sprintf("%v/%d", net.IP(p.addr[:]), p.len)
+}
+
+// 保留前 n 位, 其余位清零
+func maskIPv6(addr [16]byte, n uint8) [16]byte {
+	var masked [16]byte
+	for i := 0; i < 16 && n > 0; i++ {
+		if n >= 8 {
+			masked[i] = addr[i]
+			n -= 8
+		} else {
+			masked[i] = addr[i] & ^byte(0xff>>n)
+			n = 0
+		}
+	}
+	return masked
+}
+
+// a 和 b 相同前缀的位数, 用于源地址选择
+func commonPrefixLenIPv6(a, b [16]byte) int {
+	n := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	ipv6 分片重组
+	ipv6 只在源端分片, 分片信息放在 Fragment 扩展首部中:
+
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|  Next Header  |   Reserved    |      Fragment Offset    |Res|M|
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|                         Identification                        |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	Fragment 首部之前的是不可分片部分, 每个分片都有一份, 重组后以偏移为 0 的分片为准
+	与 ipv4 不同的地方:
+	- 分片按 (src, dst, id) 区分, 上层协议在第一个分片的首部链中
+	- 分片之间不允许重叠 (RFC 5722), 出现重叠时丢弃整个数据报
+	- 偏移为 0 且没有 M 标志的 "原子分片" 不进入重组队列 (RFC 6946)
+*/
+const (
+	ipv6ReassemblyTimeout      = 60 * time.Second
+	ipv6ReassemblyHigh         = 4 << 20
+	ipv6ReassemblyLow          = 3 << 20
+	ipv6ReassemblyMaxFragments = 256 // 单个数据报最多的分片数, 防止大量极小的分片耗尽资源
+	ipv6MaxPayloadSize         = 0xffff
+
+	ipv6FragmentMore       = 0x1
+	ipv6FragmentOffsetMask = 0xfff8
+)
+
+type ipv6FragmentKey struct {
+	vrf      *vrf
+	src, dst [16]byte
+	id       uint32
+}
+
+type ipv6FragmentQueue struct {
+	key       ipv6FragmentKey
+	dev       *device
+	first     *ipv6          // 偏移为 0 的分片, 它的不可分片部分用于重组后的数据报
+	fragments []ipv4Fragment // 按 offset 排序, 互不重叠
+	total     int            // 收到最后一个分片后才能确定可分片部分的长度, 之前为 -1
+	size      int
+	created   time.Time
+	timer     *time.Timer
+}
+
+type ipv6Reassembler struct {
+	queues map[ipv6FragmentKey]*ipv6FragmentQueue
+	mem    int
+	mutex  sync.Mutex
+}
+
+var ipv6Fragments = newIPv6Reassembler()
+
+func newIPv6Reassembler() *ipv6Reassembler {
+	return &ipv6Reassembler{
+		queues: make(map[ipv6FragmentKey]*ipv6FragmentQueue),
+	}
+}
+
+/*
+	加入一个分片, f 的最后一个扩展首部是 Fragment, payload 是分片的数据
+	数据报收齐时返回重组后的数据报, 否则返回错误
+*/
+func (r *ipv6Reassembler) add(dev *device, f *ipv6) (*ipv6, error) {
+	ext := f.extensions[len(f.extensions)-1]
+	field := binary.BigEndian.Uint16(ext.data[2:4])
+	offset := int(field & ipv6FragmentOffsetMask)
+	more := field&ipv6FragmentMore != 0
+	end := offset + len(f.payload)
+	unfragmentable := ext.offset - ipv6HeaderSize
+	if more && len(f.payload)&7 != 0 { // 除了最后一个分片, 分片长度必须是 8 的整数倍
+		return nil, &ipv6ParameterProblemError{code: icmpv6CodeErroneousHeader, pointer: 4, reason: "fragment length is not a multiple of 8"}
+	}
+	if unfragmentable+8+end > ipv6MaxPayloadSize {
+		return nil, &ipv6ParameterProblemError{code: icmpv6CodeErroneousHeader, pointer: ext.offset + 2, reason: "fragment exceeds max payload size"}
+	}
+	if offset == 0 && !more {
+		return f.reassembled(f.payload)
+	}
+	key := ipv6FragmentKey{vrf: dev.vrf(), src: f.header.Src, dst: f.header.Dst, id: binary.BigEndian.Uint32(ext.data[4:8])}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	q := r.queues[key]
+	if q == nil {
+		q = &ipv6FragmentQueue{key: key, dev: dev, total: -1, created: time.Now()}
+		q.timer = time.AfterFunc(ipv6ReassemblyTimeout, func() { r.expire(q) })
+		r.queues[key] = q
+	}
+	if !more {
+		if q.total >= 0 && q.total != end || end < q.end() {
+			r.dropUnlocked(q)
+			return nil, errors.New("inconsistent fragment length")
+		}
+		q.total = end
+	} else if q.total >= 0 && end > q.total {
+		r.dropUnlocked(q)
+		return nil, errors.New("fragment beyond end of datagram")
+	}
+	added := q.insert(offset, f.payload)
+	if added < 0 {
+		r.dropUnlocked(q)
+		return nil, errors.New("overlapping fragment")
+	}
+	r.mem += added
+	if offset == 0 && q.first == nil {
+		first := *f
+		first.extensions = make([]ipv6Extension, len(f.extensions))
+		for i, e := range f.extensions {
+			e.data = append([]byte(nil), e.data...)
+			first.extensions[i] = e
+		}
+		first.payload = q.fragments[0].data
+		q.first = &first
+	}
+	if len(q.fragments) > ipv6ReassemblyMaxFragments {
+		r.dropUnlocked(q)
+		return nil, errors.New("too many fragments")
+	}
+	if !q.complete() {
+		r.evictUnlocked()
+		return nil, errors.New("fragment queued")
+	}
+	r.dropUnlocked(q)
+	data := make([]byte, 0, q.total)
+	for _, frag := range q.fragments {
+		data = append(data, frag.data...)
+	}
+	return q.first.reassembled(data)
+}
+
+// 插入分片, 返回新增的字节数, 与已有分片完全相同时忽略, 与已有分片重叠时返回 -1
+func (q *ipv6FragmentQueue) insert(start int, data []byte) int {
+	end := start + len(data)
+	for _, frag := range q.fragments {
+		fs, fe := frag.offset, frag.offset+len(frag.data)
+		if fs == start && fe == end {
+			return 0
+		}
+		if start < fe && fs < end {
+			return -1
+		}
+	}
+	q.fragments = append(q.fragments, ipv4Fragment{offset: start, data: append([]byte(nil), data...)})
+	sort.Slice(q.fragments, func(i, j int) bool {
+		return q.fragments[i].offset < q.fragments[j].offset
+	})
+	q.size += len(data)
+	return len(data)
+}
+
+func (q *ipv6FragmentQueue) end() int {
+	if len(q.fragments) == 0 {
+		return 0
+	}
+	last := q.fragments[len(q.fragments)-1]
+	return last.offset + len(last.data)
+}
+
+func (q *ipv6FragmentQueue) complete() bool {
+	return q.first != nil && q.total >= 0 && q.size == q.total
+}
+
+/*
+	用分片 f 的不可分片部分加上完整的可分片部分组成数据报
+	可分片部分可能还有扩展首部 (比如 Destination Options), 所以重新 decode 一次
+*/
+func (f *ipv6) reassembled(data []byte) (*ipv6, error) {
+	whole := *f
+	whole.extensions = f.extensions[:len(f.extensions)-1]
+	whole.payload = data
+	var out ipv6
+	if err := out.decode(whole.encode()); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (r *ipv6Reassembler) dropUnlocked(q *ipv6FragmentQueue) {
+	if r.queues[q.key] != q {
+		return
+	}
+	q.timer.Stop()
+	delete(r.queues, q.key)
+	r.mem -= q.size
+}
+
+// 内存超限时从最老的数据报开始丢弃
+func (r *ipv6Reassembler) evictUnlocked() {
+	if r.mem <= ipv6ReassemblyHigh {
+		return
+	}
+	queues := make([]*ipv6FragmentQueue, 0, len(r.queues))
+	for _, q := range r.queues {
+		queues = append(queues, q)
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].created.Before(queues[j].created)
+	})
+	for _, q := range queues {
+		if r.mem <= ipv6ReassemblyLow {
+			break
+		}
+		r.dropUnlocked(q)
+	}
+}
+
+// 超时后丢弃, 收到过第一个分片时回复 time exceeded (reassembly)
+func (r *ipv6Reassembler) expire(q *ipv6FragmentQueue) {
+	r.mutex.Lock()
+	if r.queues[q.key] != q {
+		r.mutex.Unlock()
+		return
+	}
+	r.dropUnlocked(q)
+	r.mutex.Unlock()
+	if q.first != nil {
+		if err := q.dev.sendIcmpv6Error(q.first, icmpv6TypeTimeExceeded, icmpv6CodeReassemblyExceeded, 0); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	ipv6 路由表, 与 ipv4 的路由表相同: 最长前缀匹配, 前缀长度相同时选择 metric 最小的
+	gateway 为 :: 表示目的地址直连, ipv6 的网关通常是路由器的链路本地地址
+*/
+type ipv6Route struct {
+	prefix    ipv6Prefix
+	gateway   [16]byte
+	dev       *device
+	metric    int
+	connected bool      // 由设备地址自动生成的直连路由
+	redirect  bool      // 由 ICMPv6 重定向生成的主机路由
+	expires   time.Time // RA 通告的直连前缀的到期时间, 零值表示永久
+}
+
+type ipv6RouteTable struct {
+	storage []*ipv6Route
+	mutex   sync.RWMutex
+}
+
+var ipv6Routes = newIPv6RouteTable()
+
+func newIPv6RouteTable() *ipv6RouteTable {
+	return &ipv6RouteTable{}
+}
+
+func (tbl *ipv6RouteTable) add(route *ipv6Route) error {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for _, r := range tbl.storage {
+		if r.prefix == route.prefix && r.metric == route.metric && r.dev == route.dev && r.gateway == route.gateway {
+			return errors.New("route already exists")
+		}
+	}
+	tbl.storage = append(tbl.storage, route)
+	sort.SliceStable(tbl.storage, func(i, j int) bool {
+		if tbl.storage[i].prefix.len != tbl.storage[j].prefix.len {
+			return tbl.storage[i].prefix.len > tbl.storage[j].prefix.len
+		}
+		return tbl.storage[i].metric < tbl.storage[j].metric
+	})
+	return nil
+}
+
+// 删除匹配的路由, metric 小于 0 时不比较 metric
+func (tbl *ipv6RouteTable) remove(prefix ipv6Prefix, metric int) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for i, r := range tbl.storage {
+		if r.prefix == prefix && (metric < 0 || r.metric == metric) {
+			tbl.storage = append(tbl.storage[:i], tbl.storage[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (tbl *ipv6RouteTable) removeConnected(dev *device, prefix ipv6Prefix) bool {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	for i, r := range tbl.storage {
+		if r.connected && r.dev == dev && r.prefix == prefix {
+			tbl.storage = append(tbl.storage[:i], tbl.storage[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (tbl *ipv6RouteTable) removeDevice(dev *device) {
+	tbl.removeIf(func(r *ipv6Route) bool { return r.dev == dev })
+}
+
+// 删除满足 cond 的路由, 返回删除的条数
+func (tbl *ipv6RouteTable) removeIf(cond func(r *ipv6Route) bool) int {
+	tbl.mutex.Lock()
+	defer tbl.mutex.Unlock()
+	kept := tbl.storage[:0]
+	for _, r := range tbl.storage {
+		if !cond(r) {
+			kept = append(kept, r)
+		}
+	}
+	n := len(tbl.storage) - len(kept)
+	tbl.storage = kept
+	return n
+}
+
+// 返回匹配的路由以及下一跳地址
+func (tbl *ipv6RouteTable) lookup(dst [16]byte) (*ipv6Route, [16]byte) {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	for _, r := range tbl.storage {
+		if r.prefix.contains(dst) {
+			if r.gateway == ipv6Unspecified {
+				return r, dst
+			}
+			return r, r.gateway
+		}
+	}
+	return nil, dst
+}
+
+func (tbl *ipv6RouteTable) entries() []ipv6Route {
+	tbl.mutex.RLock()
+	defer tbl.mutex.RUnlock()
+	list := make([]ipv6Route, 0, len(tbl.storage))
+	for _, r := range tbl.storage {
+		list = append(list, *r)
+	}
+	return list
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	ipv6 无状态地址自动配置 (SLAAC, RFC 4862)
+	- 设备启动时由 mac 生成链路本地地址 fe80::/64
+	- RA 中带 A 标志的 /64 前缀与接口标识拼成全局地址, 带 L 标志的前缀加入路由表作为直连网段
+	- 地址和前缀都有 valid/preferred 生存期, preferred 到期后地址变为 deprecated,
+	  不再作为新连接的源地址, valid 到期后删除
+	接口标识 (低 64 位) 有两种生成方式:
+	- eui64: mac 中间插入 ff:fe, 并翻转 U/L 位, 地址中会暴露 mac
+	- stable: RFC 7217, 对前缀, 设备名, DAD 重试次数和本机密钥做哈希, 同一网段内稳定, 换网段后变化
+*/
+type ipv6AddrGenMode uint8
+
+const (
+	ipv6AddrGenEUI64 ipv6AddrGenMode = iota
+	ipv6AddrGenStable
+)
+
+func (m ipv6AddrGenMode) String() string {
+	if m == ipv6AddrGenStable {
+		return "stable"
+	}
+	return "eui64"
+}
+
+const (
+	slaacInfinite       = 0xffffffff // 生存期为无穷
+	slaacMinValid       = 2 * time.Hour
+	slaacIdgenRetries   = 3 // stable 模式下 DAD 失败后重新生成地址的次数
+	slaacPrefixMetric   = 256
+	slaacPrefixFlagLink = 0x80 // L: 前缀在链路上
+	slaacPrefixFlagAuto = 0x40 // A: 可以用于自动配置地址
+	slaacAgingInterval  = time.Second
+)
+
+var (
+	ipv6AddrGen      uint32   // 由 ctl 协程修改, 收包时读取, 只能通过下面两个函数原子地访问
+	ipv6StableSecret [16]byte // stable 模式的密钥, 启动时随机生成
+)
+
+func ipv6AddrGenModeCurrent() ipv6AddrGenMode {
+	return ipv6AddrGenMode(atomic.LoadUint32(&ipv6AddrGen))
+}
+
+func setIPv6AddrGenMode(m ipv6AddrGenMode) {
+	atomic.StoreUint32(&ipv6AddrGen, uint32(m))
+}
+
+func init() {
+	rand.Read(ipv6StableSecret[:])
+}
+
+func (dev *device) eui64() [8]byte {
+	mac := dev.hardwareAddr
+	return [8]byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]}
+}
+
+// RFC 7217 的 F(Prefix, Net_Iface, Network_ID, DAD_Counter, secret_key), Network_ID 不使用
+func (dev *device) stableIID(prefix [16]byte, counter uint8) [8]byte {
+	h := sha256.New()
+	h.Write(prefix[:8])
+	h.Write([]byte(dev.name))
+	h.Write([]byte{counter})
+	h.Write(ipv6StableSecret[:])
+	var iid [8]byte
+	copy(iid[:], h.Sum(nil))
+	return iid
+}
+
+// 用前缀的高 64 位和接口标识生成地址
+func (dev *device) slaacAddress(prefix [16]byte, counter uint8) [16]byte {
+	iid := dev.eui64()
+	if ipv6AddrGenModeCurrent() == ipv6AddrGenStable {
+		iid = dev.stableIID(prefix, counter)
+	}
+	var addr [16]byte
+	copy(addr[:8], prefix[:8])
+	copy(addr[8:], iid[:])
+	return addr
+}
+
+// 生存期对应的到期时间, 无穷时为零值
+func slaacDeadline(now time.Time, lifetime uint32) time.Time {
+	if lifetime == slaacInfinite {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(lifetime) * time.Second)
+}
+
+// 设备没有链路本地地址时生成一个, 在 run 中开始 DAD 之前调用
+func (dev *device) configureLinkLocal() {
+	for _, a := range dev.ipv6Addresses() {
+		if ipv6IsLinkLocal(a.addr) {
+			return
+		}
+	}
+	dev.autoconfigure(ipv6LinkLocalNet.addr, 64, slaacInfinite, slaacInfinite, 0)
+}
+
+// 添加一个自动配置的地址, 设备运行时立即开始 DAD
+func (dev *device) autoconfigure(prefix [16]byte, prefixLen uint8, valid, preferred uint32, counter uint8) {
+	addr := dev.slaacAddress(prefix, counter)
+	if _, err := dev.addIPv6(addr, prefixLen); err != nil {
+		return
+	}
+	now := time.Now()
+	dev.mutex.Lock()
+	for _, a := range dev.ipv6Addrs {
+		if a.addr == addr {
+			a.autoconf = true
+			a.dadCounter = counter
+			a.validUntil = slaacDeadline(now, valid)
+			a.preferredUntil = slaacDeadline(now, preferred)
+		}
+	}
+	sig := dev.sig
+	dev.mutex.Unlock()
+	fmt.Printf("%sslaac%s %s %v (%s)\n", blue, reset, dev.name, net.IP(addr[:]), ipv6AddrGenModeCurrent())
+	if sig != nil {
+		go dev.startDAD(addr, sig)
+	}
+}
+
+/*
+	stable 模式下自动配置的地址 DAD 失败时, 增加 DAD_Counter 重新生成地址 (RFC 7217 6)
+	eui64 的地址重新生成也一样, 只能放弃
+*/
+func (dev *device) regenerateIPv6(a *ipv6Address) {
+	if !a.autoconf || ipv6AddrGenModeCurrent() != ipv6AddrGenStable || a.dadCounter >= slaacIdgenRetries {
+		return
+	}
+	now := time.Now()
+	valid, preferred := uint32(slaacInfinite), uint32(slaacInfinite)
+	if !a.validUntil.IsZero() {
+		valid = uint32(a.validUntil.Sub(now) / time.Second)
+	}
+	if !a.preferredUntil.IsZero() {
+		preferred = uint32(a.preferredUntil.Sub(now) / time.Second)
+	}
+	dev.removeIPv6(a.addr)
+	dev.autoconfigure(a.prefix.addr, a.prefix.len, valid, preferred, a.dadCounter+1)
+}
+
+/*
+	Prefix Information 选项
+	Prefix Length(8) L|A|Reserved1(8) Valid Lifetime(32) Preferred Lifetime(32) Reserved2(32) Prefix(128)
+*/
+func (dev *device) handlePrefixInfo(data []byte) {
+	if len(data) < 30 {
+		return
+	}
+	prefixLen, flags := data[0], data[1]
+	valid := binary.BigEndian.Uint32(data[2:6])
+	preferred := binary.BigEndian.Uint32(data[6:10])
+	var prefix [16]byte
+	copy(prefix[:], data[14:30])
+	if prefixLen > 128 || preferred > valid || ipv6IsLinkLocal(prefix) || ipv6IsMulticast(prefix) {
+		return
+	}
+	prefix = maskIPv6(prefix, prefixLen)
+	if flags&slaacPrefixFlagLink != 0 {
+		dev.updateOnLinkPrefix(ipv6Prefix{addr: prefix, len: prefixLen}, valid)
+	}
+	if flags&slaacPrefixFlagAuto != 0 && prefixLen == 64 {
+		addrLen := uint8(128) // 前缀不在链路上时, 地址不带直连路由
+		if flags&slaacPrefixFlagLink != 0 {
+			addrLen = 64
+		}
+		dev.updateAutoconf(prefix, addrLen, valid, preferred)
+	}
+}
+
+// 直连前缀的路由带有到期时间, 收到新的 RA 时刷新, valid 为 0 时立即删除
+func (dev *device) updateOnLinkPrefix(prefix ipv6Prefix, valid uint32) {
+	routes := dev.vrf().routes6
+	routes.removeIf(func(r *ipv6Route) bool {
+		return r.dev == dev && r.prefix == prefix && r.metric == slaacPrefixMetric && !r.connected
+	})
+	if valid == 0 {
+		return
+	}
+	routes.add(&ipv6Route{prefix: prefix, dev: dev, metric: slaacPrefixMetric, expires: slaacDeadline(time.Now(), valid)})
+}
+
+/*
+	更新由 prefix 自动配置的地址, 没有时新建 (valid 为 0 时不新建)
+	为了防止伪造的 RA 让地址立即失效, valid 只在以下情况下缩短 (RFC 4862 5.5.3 e):
+	新的 valid 大于两小时或者大于剩余的生存期时采用新值, 剩余不超过两小时时不变, 否则改为两小时
+*/
+func (dev *device) updateAutoconf(prefix [16]byte, prefixLen uint8, valid, preferred uint32) {
+	now := time.Now()
+	found := false
+	dev.mutex.Lock()
+	for _, a := range dev.ipv6Addrs {
+		if !a.autoconf || !ipv6SamePrefix64(a.addr, prefix) {
+			continue
+		}
+		found = true
+		received := slaacDeadline(now, valid)
+		remaining := a.validUntil.Sub(now)
+		switch {
+		case valid == slaacInfinite:
+			a.validUntil = received
+		case time.Duration(valid)*time.Second > slaacMinValid,
+			!a.validUntil.IsZero() && received.After(a.validUntil):
+			a.validUntil = received
+		case !a.validUntil.IsZero() && remaining <= slaacMinValid:
+		default:
+			a.validUntil = now.Add(slaacMinValid)
+		}
+		a.preferredUntil = slaacDeadline(now, preferred)
+		if preferred > 0 && a.state == ipv6AddrDeprecated {
+			a.state = ipv6AddrPreferred
+		}
+	}
+	dev.mutex.Unlock()
+	if !found && valid > 0 {
+		dev.autoconfigure(prefix, prefixLen, valid, preferred, 0)
+	}
+}
+
+func ipv6SamePrefix64(a, b [16]byte) bool {
+	return bytes.Equal(a[:8], b[:8])
+}
+
+/*
+	MTU 选项: Reserved(16) MTU(32)
+	只能在最小 MTU 与链路 MTU 之间, 不影响 ipv4
+*/
+func (dev *device) handleMTUOption(data []byte) {
+	if len(data) < 6 {
+		return
+	}
+	mtu := int(binary.BigEndian.Uint32(data[2:6]))
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	if mtu < ipv6MinMTU || mtu > dev.mtu {
+		return
+	}
+	dev.mtu6 = mtu
+}
+
+// ipv6 使用的 MTU, 没有收到 RA 的 MTU 选项时与链路相同
+func (dev *device) ipv6MTU() int {
+	dev.mutex.RLock()
+	defer dev.mutex.RUnlock()
+	if dev.mtu6 != 0 {
+		return dev.mtu6
+	}
+	return dev.mtu
+}
+
+// 定期处理地址和直连前缀的生存期, 直到 sig 被关闭
+func (dev *device) ageIPv6(sig chan struct{}) {
+	ticker := time.NewTicker(slaacAgingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sig:
+			return
+		case now := <-ticker.C:
+			dev.expireIPv6(now)
+		}
+	}
+}
+
+func (dev *device) expireIPv6(now time.Time) {
+	var expired [][16]byte
+	dev.mutex.Lock()
+	for _, a := range dev.ipv6Addrs {
+		switch {
+		case !a.validUntil.IsZero() && now.After(a.validUntil):
+			expired = append(expired, a.addr)
+		case !a.preferredUntil.IsZero() && now.After(a.preferredUntil) && a.state == ipv6AddrPreferred:
+			a.state = ipv6AddrDeprecated
+			fmt.Printf("%sslaac%s %s %v deprecated\n", blue, reset, dev.name, net.IP(a.addr[:]))
+		}
+	}
+	dev.mutex.Unlock()
+	for _, addr := range expired {
+		dev.removeIPv6(addr)
+		fmt.Printf("%sslaac%s %s %v expired\n", blue, reset, dev.name, net.IP(addr[:]))
+	}
+	dev.vrf().routes6.removeIf(func(r *ipv6Route) bool {
+		return r.dev == dev && !r.expires.IsZero() && now.After(r.expires)
+	})
+}
@@ -1,35 +1,150 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"sync"
 	"time"
 )
 
+const (
+	tcpConnQueueSize  = 64
+	tcpDefaultWindow  = 65535
+	tcpSynRecvTimeout = 75 * time.Second // 还没有完成握手的连接的存活时间
+	tcpIdleTimeout    = 10 * time.Minute // 已建立的连接收不到报文段多久后中止
+	tcpMaxHalfOpen    = 128              // 每个监听端口上还没有完成握手的连接数上限, 相当于 listen 的 backlog
+)
+
+var (
+	errNoConnection    = errors.New("no tcp connection")
+	errConnectionReset = errors.New("connection reset by peer")
+	errTimedOut        = errors.New("connection timed out")
+)
+
 type conn struct {
 	key           connKey
+	host          *tcpHost
+	dev           *device // 收到 SYN 的设备, 对端是链路本地地址时从它发送
 	inputCh       chan *tcp
 	outputCh      chan *tcp
+	abort         chan struct{} // 连接被中止 (icmp 硬错误, 超时) 时关闭, 连接的处理流程随即退出
 	closed        bool
+	halfOpen      bool // 计入监听端口的半连接数, 由 host.connsLock 保护
 	toApplication chan []byte
-	timer         time.Timer
+	timer         *time.Timer   // 到期时中止连接
+	idle          time.Duration // 不为 0 时每收到一个报文段 timer 重新计时
 	err           error
+	softErr       error      // 最近收到的 icmp 软错误, 连接超时中止时作为原因报告
+	mutex         sync.Mutex // 保护 err, softErr, abort 以及 TCB 中的 sender.unAck 和 sender.next
 	TCB
 }
 
 var ExceptQuit *tcp = nil
 
+/*
+	读取下一个报文段, !ok 表示连接被中止, 原因在 err 中
+	inputCh 不会被关闭, 所以向它投递报文段的一方不需要和连接的退出同步
+*/
 func (c *conn) input() (datagram *tcp, ok bool) {
-	datagram, ok = <-c.inputCh
+	select {
+	case <-c.abort:
+	default:
+		select {
+		case datagram, ok = <-c.inputCh:
+		case <-c.abort:
+		}
+	}
+	if ok && c.idle > 0 {
+		c.timer.Reset(c.idle)
+	}
 	return
 }
 
+// 交给 host.run 发送, 由连接决定的字段在这里填写, ExceptQuit 表示连接已经结束
 func (c *conn) output(datagram *tcp) {
 	if datagram == ExceptQuit {
 		close(c.outputCh)
 	} else {
+		datagram.header.WindowSize = uint16(c.receiver.window)
+		if datagram.header.Flags&flagAck > 0 {
+			datagram.header.AckNum = c.receiver.next
+		}
 		c.outputCh <- datagram
 	}
-	HostTCP.output <- c
+	c.host.output <- c
+}
+
+// 确认按顺序收到的数据
+func (c *conn) ack() {
+	datagram := &tcp{}
+	datagram.header.Flags = flagAck
+	datagram.header.SeqNum = c.sender.next
+	c.output(datagram)
+}
+
+func (c *conn) setErr(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.err = err
+}
+
+func (c *conn) error() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// 以 err 中止连接, 只有第一次调用有效
+func (c *conn) abortWith(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.abort:
+		return
+	default:
+	}
+	c.err = err
+	close(c.abort)
+}
+
+// d 之后中止连接, 有软错误时报告最近的软错误, 否则报告超时 (RFC 1122 4.2.3.9)
+func (c *conn) setTimer(d time.Duration) {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timer = time.AfterFunc(d, func() {
+		c.mutex.Lock()
+		err := c.softErr
+		c.mutex.Unlock()
+		if err == nil {
+			err = errTimedOut
+		}
+		c.abortWith(err)
+	})
+}
+
+// 完成握手, 不再计入监听端口的半连接数, 之后收不到报文段 tcpIdleTimeout 才中止
+func (c *conn) establish() {
+	c.host.connsLock.Lock()
+	c.host.releaseUnlocked(c)
+	c.host.connsLock.Unlock()
+	c.idle = tcpIdleTimeout
+	c.setTimer(c.idle)
+}
+
+// 更新已发送但未确认的序列号范围, icmp 差错要用它检查引用的序列号
+func (c *conn) setSender(unAck, next uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sender.unAck, c.sender.next = unAck, next
+}
+
+// seq 是否在 [unAck, next] 之内, 序列号会回绕, 所以按 32 位的差比较
+func (c *conn) inFlight(seq uint32) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return int32(seq-c.sender.unAck) >= 0 && int32(c.sender.next-seq) >= 0
 }
 
 type TCB struct {
@@ -57,100 +172,238 @@ func (c *conn) checkSeq(datagram *tcp) bool {
 		接收到的包的序列号如果小于我们期待接收的下一个数据报的序列号(receiver.next),那么这是一个
 		重传的数据包,同时,如果序列号大于 receiver.next + receiver.window,表示可能是对方传送太多,
 		当然也可能是别的原因.总之这些都是无用的数据报
+		序列号会回绕, 所以按 32 位的差比较
 	*/
 	if len(datagram.payload) > 0 && tcb.receiver.window == 0 ||
-		datagram.header.SeqNum < tcb.receiver.next ||
-		datagram.header.SeqNum > (tcb.receiver.next+tcb.receiver.window) {
+		int32(datagram.header.SeqNum-tcb.receiver.next) < 0 ||
+		int32(datagram.header.SeqNum-(tcb.receiver.next+tcb.receiver.window)) > 0 {
 
-		datagram = &tcp{}
-		datagram.header.Flags = flagAck // 向对方发送 ack
-		datagram.header.SeqNum = tcb.sender.next
-		c.output(datagram)
+		c.ack() // 向对方发送 ack
 		return true
 	}
 	return false
 }
 
 func (c *conn) checkAckNum(datagram *tcp) bool {
-	if !(c.sender.unAck < datagram.header.AckNum && datagram.header.AckNum <= c.sender.next) {
-		// 确保对方发过来的 ack_seq 是合法的
+	ack := datagram.header.AckNum
+	if int32(ack-c.sender.unAck) < 0 || int32(ack-c.sender.next) > 0 {
+		// 确保对方发过来的 ack_seq 是合法的, 等于 unAck 的是重复的确认, 也是合法的
 		return true
 	}
 	// 一旦接收到 ack 表示 ackNum 序号之前的数据都已经收到了
-	c.sender.unAck = datagram.header.AckNum
+	c.setSender(ack, c.sender.next)
 	return false
 }
 
 type connKey struct { // 一对地址指定一条连接
-	aIP, bIP     uint32
+	aIP, bIP     [16]byte // ipv4 地址用映射地址 ::ffff:a.b.c.d 表示
 	aPort, bPort uint16
 }
 type tcpHost struct {
 	conns     map[connKey]*conn
-	connsLock sync.Mutex
-	output    chan *conn
-	dev *device
+	listeners map[uint16]int // 监听的本地端口, 以及其上还没有完成握手的连接数
+	connsLock sync.Mutex     // 保护 conns, listeners 以及 conn.halfOpen
+	output    chan *conn     // 有报文段要发送或者已经结束的连接, 第一次 listen 时创建并启动 run
+	dev       *device
+	vrf       *vrf // 端口空间所属的 VRF, nil 表示 defaultVRF
 }
 
 var HostTCP = tcpHost{}
 
+func (host *tcpHost) domain() *vrf {
+	if host.vrf == nil {
+		return defaultVRF
+	}
+	return host.vrf
+}
+
+// 在所有本地地址上监听 port
+func (host *tcpHost) listen(port uint16) error {
+	host.connsLock.Lock()
+	defer host.connsLock.Unlock()
+	if _, ok := host.listeners[port]; ok {
+		return errors.New("address already in use")
+	}
+	if host.listeners == nil {
+		host.listeners = make(map[uint16]int)
+	}
+	host.listeners[port] = 0
+	if host.output == nil {
+		host.output = make(chan *conn, tcpConnQueueSize)
+		go host.run()
+	}
+	return nil
+}
+
+/*
+	把收到的报文段交给所属的连接, 监听的端口收到 SYN 时建立新的连接
+	返回 errNoConnection 时由调用者按 CLOSED 状态回复 RST
+	半连接数达到 tcpMaxHalfOpen 时丢弃 SYN, 对方会重传
+*/
+func (host *tcpHost) input(dev *device, upper ipPacket, f *tcp) error {
+	var key connKey
+	switch ip := upper.(type) {
+	case *ipv4:
+		key.aIP, key.bIP = ipv4MappedIPv6(ip.header.Dst), ipv4MappedIPv6(ip.header.Src)
+	case *ipv6:
+		key.aIP, key.bIP = ip.header.Dst, ip.header.Src
+	default:
+		return errNoConnection
+	}
+	key.aPort, key.bPort = f.header.DstPort, f.header.SrcPort
+	host.connsLock.Lock()
+	c, ok := host.conns[key]
+	if halfOpen, listening := host.listeners[key.aPort]; !ok && listening {
+		switch {
+		case f.header.Flags&flagRst > 0: // LISTEN 状态忽略 RST
+			host.connsLock.Unlock()
+			return errors.New("rst to listening port")
+		case f.header.Flags&flagAck > 0:
+		case f.header.Flags&flagSyn > 0:
+			if halfOpen >= tcpMaxHalfOpen {
+				host.connsLock.Unlock()
+				return fmt.Errorf("too many half-open connections on port %d", key.aPort)
+			}
+			s := host.newConnUnlocked(dev, key)
+			c, ok = &s.conn, true
+			go s.run()
+		default: // 既没有 SYN 也没有 ACK, 丢弃
+			host.connsLock.Unlock()
+			return errors.New("tcp segment without syn to listening port")
+		}
+	}
+	host.connsLock.Unlock()
+	if !ok {
+		return errNoConnection
+	}
+	datagram := *f
+	datagram.payload = append([]byte(nil), f.payload...) // 收包的缓冲区会被复用
+	select {
+	case c.inputCh <- &datagram:
+	default: // 连接处理不过来, 丢弃, 对方会重传
+	}
+	return errors.New("do nothing")
+}
+
+func (host *tcpHost) newConnUnlocked(dev *device, key connKey) *tcpConnServer {
+	if host.conns == nil {
+		host.conns = make(map[connKey]*conn)
+	}
+	s := &tcpConnServer{conn{
+		key:           key,
+		host:          host,
+		dev:           dev,
+		inputCh:       make(chan *tcp, tcpConnQueueSize),
+		outputCh:      make(chan *tcp, tcpConnQueueSize),
+		abort:         make(chan struct{}),
+		halfOpen:      true,
+		toApplication: make(chan []byte, tcpConnQueueSize),
+	}}
+	s.receiver.window = tcpDefaultWindow
+	s.setTimer(tcpSynRecvTimeout)
+	host.conns[key] = &s.conn
+	host.listeners[key.aPort]++
+	return s
+}
+
+func (host *tcpHost) releaseUnlocked(c *conn) {
+	if !c.halfOpen {
+		return
+	}
+	c.halfOpen = false
+	if n, ok := host.listeners[c.key.aPort]; ok && n > 0 {
+		host.listeners[c.key.aPort] = n - 1
+	}
+}
+
+/*
+	依次发送连接交来的报文段, 每个通知对应 outputCh 中的一个报文段,
+	outputCh 关闭表示连接已经结束, 这时之前的报文段都已经发出
+*/
 func (host *tcpHost) run() {
 	var datagram *tcp
+	var ok bool
 
 	for c := range host.output {
-		if c.closed {
-			host.connsLock.Lock()
+		if datagram, ok = <-c.outputCh; ok {
+			host.send(c, datagram)
+			continue
+		}
+		host.connsLock.Lock()
+		if host.conns[c.key] == c {
 			delete(host.conns, c.key)
-			host.connsLock.Unlock()
-			if c.err != nil{
-				datagram = &tcp{}
-				datagram.header.Flags = flagRst // 向对端发送 RST
-				datagram.header.SeqNum, c.sender.unAck =
-					c.sender.next, c.sender.next // rst 不消耗序列号
-				/*
-					一般来说，无论何时一个报文段出现错误，TCP都会发出一个RST报文段
-					RST报文段，接收方不会进行确认。收到RST的一方将终止该连接，并通知应用层连接复位
-				*/
-			}
-		}else{
-			for datagram = range c.outputCh{
-
-			}
 		}
+		host.releaseUnlocked(c)
+		host.connsLock.Unlock()
+		err := c.error()
+		if err == nil {
+			continue
+		}
+		fmt.Printf("%s tcp%s port %d closed: %v\n", green, reset, c.key.aPort, err)
+		var unreachable *icmpError
+		if errors.Is(err, errConnectionReset) || errors.Is(err, errTimedOut) || errors.As(err, &unreachable) {
+			continue // 对方已经复位了连接, 或者对方不可达, 不需要 RST
+		}
+		datagram = &tcp{}
+		datagram.header.Flags = flagRst // 向对端发送 RST
+		datagram.header.SeqNum = c.sender.next
+		c.setSender(c.sender.next, c.sender.next) // rst 不消耗序列号
+		/*
+			一般来说，无论何时一个报文段出现错误，TCP都会发出一个RST报文段
+			RST报文段，接收方不会进行确认。收到RST的一方将终止该连接，并通知应用层连接复位
+		*/
+		host.send(c, datagram)
 	}
 }
 
+/*
+	把 icmp 差错交给 local:port 与 e.dst:e.dstPort 之间的连接 (RFC 1122 4.2.3.9)
+	引用的序列号不在 [unAck, next] 之内时忽略, 避免伪造的差错报文中止连接 (RFC 5927)
+	硬错误中止连接, 软错误只记录下来; 需要分片的差错已经更新了路径 MTU, 连接不需要处理
+*/
+func (host *tcpHost) notify(local [4]byte, port uint16, seq uint32, e *icmpError) bool {
+	key := connKey{
+		aIP: ipv4MappedIPv6(local), bIP: ipv4MappedIPv6(e.dst),
+		aPort: port, bPort: e.dstPort,
+	}
+	host.connsLock.Lock()
+	c, ok := host.conns[key]
+	host.connsLock.Unlock()
+	if !ok || !c.inFlight(seq) {
+		return false
+	}
+	switch {
+	case e.fragmentationNeeded():
+	case e.hard():
+		c.abortWith(e) // 连接的处理流程退出后由 run 从 conns 中删除
+	default:
+		c.mutex.Lock()
+		c.softErr = e
+		c.mutex.Unlock()
+	}
+	return true
+}
+
 func (host *tcpHost) send(c *conn, datagram *tcp){
 	// 因为是异步发送， 所以要自己构造返回的以太网帧
 	datagram.header.DstPort, datagram.header.SrcPort =
 		c.key.bPort, c.key.aPort
+	datagram.header.DataOffset = 5 << 4 // 不发送选项
 
-	ip := ipv4{
-		header: struct {
-			Version_IHL          uint8
-			TOS                  uint8
-			Len                  uint16
-			Id                   uint16
-			Flags_FragmentOffset uint16
-			TTL                  uint8
-			Protocol             ipv4ProtocolType
-			Checksum             uint16
-			Src                  [4]byte
-			Dst                  [4]byte
-		}{
-			// TODO
-		},
-	}
-	ip.payload = datagram.encode(&ip)
-
-	e := eth{
-		header: struct {
-			Dst  [6]byte
-			Src  [6]byte
-			Type ethProtocolType
-		}{},
-		payload: ip.encode(),
-	}
-
-	host.dev.Write(e.encode())
+	var err error
+	if src, ok := ipv4Unmapped(c.key.aIP); ok {
+		dst, _ := ipv4Unmapped(c.key.bIP)
+		// 这里的 ip 首部只用于计算校验和的伪首部, 真正的首部由 ipv4Output 填写
+		var ip ipv4
+		ip.header.Src, ip.header.Dst = src, dst
+		err = host.domain().ipv4Output(src, dst, ipv4ProtocolTypeTCP, datagram.encode(&ip), 0, 0)
+	} else {
+		ip := &ipv6{protocol: ipv6HeaderTCP}
+		ip.header.Src, ip.header.Dst = c.key.aIP, c.key.bIP
+		ip.payload = datagram.encode(ip)
+		err = host.domain().sendIPv6(ip, c.dev)
+	}
+	if err != nil {
+		log.Println(err)
+	}
 }
@@ -11,19 +11,21 @@ type tcpConnServer struct {
 
 func (c *tcpConnServer) run() {
 	defer func() {
-		c.closed = true
-		c.output(nil)
 		if err := recover(); err != nil {
-			c.err = errors.New(fmt.Sprintf("panic: %v", err))
+			c.setErr(errors.New(fmt.Sprintf("panic: %v", err)))
 			// 出现异常，上层应该发送 RST 表示要异常释放该连接
 			// 丢弃任何待发数据并立即发送复位报文段
 		}
+		c.timer.Stop()
+		c.closed = true
+		c.output(ExceptQuit)
 	}()
 
 	var datagram, fin *tcp
+	var data []byte
 	var ok bool
 LISTEN:
-	if datagram, ok = c.input(); !ok { //  !ok 时， 即被动关闭 c.inputCh 时，表示超时
+	if datagram, ok = c.input(); !ok { //  !ok 时， 即连接被中止时，可能是超时
 		return
 	}
 	if datagram.header.Flags&flagRst > 0 || // 检查 RST
@@ -33,10 +35,12 @@ LISTEN:
 	}
 	c.TCB.sender.ISN = 0x1234
 	c.TCB.receiver.IRS, c.TCB.receiver.next = datagram.header.SeqNum, datagram.header.SeqNum+1
-	datagram.header.Flags = flagAck | flagSyn // 向对方发送 ack 以及 syn
+	// 先记下 SYN 占用的序列号, 这样对 SYN+ACK 的 icmp 差错也能找到该连接
+	c.setSender(c.TCB.sender.ISN, c.TCB.sender.ISN+1)
+	datagram = &tcp{}
+	datagram.header.Flags = flagAck | flagSyn // 向对方发送 ack 以及 syn, 不带 SYN 中的选项
 	datagram.header.SeqNum = c.TCB.sender.ISN
 	c.output(datagram)
-	c.TCB.sender.next, c.TCB.sender.unAck = c.TCB.sender.ISN+1, c.TCB.sender.ISN
 SYN_RECV:
 	if datagram, ok = c.input(); !ok {
 		return
@@ -47,16 +51,18 @@ SYN_RECV:
 	if c.checkSeq(datagram) || // 检查是否是重复发送的包
 		datagram.header.Flags&flagAck == 0 || // 检查 ACK 标志, 应该为 1
 		datagram.header.Flags&flagSyn > 0 || // 检查 SYN 标志， 应该为 0
+		datagram.header.AckNum != c.TCB.sender.next || // 必须确认了我们的 SYN
 		c.checkAckNum(datagram) { // 检查 AckNUM 的值 是否合法
 		goto SYN_RECV
 	}
 	// 到这一步说明 收到了正确的 ACK， 完成握手
+	c.establish()
 ESTABLISHED:
 	if datagram, ok = c.input(); !ok {
 		return
 	}
 	if datagram.header.Flags&flagRst > 0 {
-		c.err = errors.New("RST when ESTABLISHED")
+		c.setErr(fmt.Errorf("RST when ESTABLISHED: %w", errConnectionReset))
 		goto CLOSED // 如果收到 RST 包，表示对方异常中止该连接
 	}
 	if c.checkSeq(datagram) ||
@@ -65,32 +71,48 @@ ESTABLISHED:
 	}
 	if datagram.header.Flags&flagSyn > 0 ||
 		c.checkAckNum(datagram) {
-		c.err = errors.New("Except Syn or Ack when ESTABLISHED")
+		c.setErr(errors.New("Except Syn or Ack when ESTABLISHED"))
 		goto CLOSED
 	}
-	if datagram.header.Flags&flagFin > 0 && datagram.header.SeqNum == c.TCB.receiver.next {
-		goto CLOSE_WAIT
+	data = datagram.payload[datagram.optionsLen():]
+	if (len(data) > 0 || datagram.header.Flags&flagFin > 0) && datagram.header.SeqNum != c.TCB.receiver.next {
+		c.ack() // 不是期待的下一个报文段, 不缓存乱序的数据, 重复确认让对方按顺序重传
+		goto ESTABLISHED
 	}
 	// TODO 检查URG
-	if len(datagram.payload) > 0 { // 有数据
-		c.toApplication <- datagram.payload
+	if len(data) > 0 { // 有数据
+		select {
+		case c.toApplication <- data:
+			c.TCB.receiver.next += uint32(len(data))
+		default: // 没有应用读取或者读得太慢, 丢弃, 对方收不到确认会重传
+			c.ack()
+			goto ESTABLISHED
+		}
+	}
+	if datagram.header.Flags&flagFin > 0 {
+		goto CLOSE_WAIT
+	}
+	if len(data) > 0 {
+		c.ack()
 	}
 	goto ESTABLISHED
 CLOSE_WAIT:
-	datagram.header.Flags = flagAck
-	c.output(datagram)
+	c.TCB.receiver.next++ // FIN 占用一个序列号
+	c.ack()
 	// 回传一个 ACK 表示 已经接收到你的 FIN. 此时，对方不再发送报文，但可以接收报文
 
 	close(c.toApplication)
 	fin = &tcp{}
-	fin.header.Flags = flagFin
+	fin.header.Flags = flagFin | flagAck
+	fin.header.SeqNum = c.TCB.sender.next
+	c.setSender(c.TCB.sender.unAck, c.TCB.sender.next+1)
 	c.output(fin) // 主动传一个 FIN 表示这边已经处理完了数据，可以关闭了
 LAST_ACK:
 	if datagram, ok = c.input(); !ok {
 		return
 	}
 	if datagram.header.Flags&flagRst > 0 {
-		c.err = errors.New("RST when LAST_ACK")
+		c.setErr(fmt.Errorf("RST when LAST_ACK: %w", errConnectionReset))
 		goto CLOSED
 	}
 	if c.checkSeq(datagram) ||
@@ -99,9 +121,12 @@ LAST_ACK:
 	}
 	if datagram.header.Flags&flagSyn > 0 ||
 		c.checkAckNum(datagram) {
-		c.err = errors.New("Except Syn or Ack when LAST_ACK")
+		c.setErr(errors.New("Except Syn or Ack when LAST_ACK"))
 		goto CLOSED
 	}
+	if c.TCB.sender.unAck != c.TCB.sender.next {
+		goto LAST_ACK // 还没有确认我们的 FIN
+	}
 CLOSED:
 	return
 }
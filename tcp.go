@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 )
@@ -57,31 +58,16 @@ type tcp struct {
 	payload []byte
 }
 
-func (f *tcp) CheckSum(upper *ipv4) uint16 {
-	// 首先解释下伪首部的概念，伪首部的数据都是从IP数据报头获取的
-	// 其目的是让TCP检查数据是否已经正确到达目的地，只是单纯为了做校验用的。
-	var pseudoHeader = struct {
-		src   [4]byte
-		dst   [4]byte
-		_     uint8 // 此处置 0, 和下面的 uint8 组成 16 位
-		proto ipv4ProtocolType
-		tlen  uint16 // tcp 长度
-	}{
-		src:   upper.header.Src,
-		dst:   upper.header.Dst,
-		proto: upper.header.Protocol,
-		tlen:  upper.header.Len - (uint16(upper.header.Version_IHL&0x0f)<<2),
-	}
+// 校验和包括由网络层首部得到的伪首部, ipv4 和 ipv6 的伪首部不同
+func (f *tcp) CheckSum(upper ipPacket) uint16 {
 	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, &pseudoHeader)
 	binary.Write(buf, binary.BigEndian, &f.header)
 	binary.Write(buf, binary.BigEndian, f.payload)
-	b := buf.Bytes()
-	return CheckSum16(b, len(b), 0)
+	return transportCheckSum(upper, uint8(ipv4ProtocolTypeTCP), buf.Bytes())
 }
 
-func (f *tcp) decode(upper *ipv4) (err error) {
-	var buf = bytes.NewBuffer(upper.payload)
+func (f *tcp) decode(upper ipPacket) (err error) {
+	var buf = bytes.NewBuffer(upper.upperPayload())
 	if err = binary.Read(buf, binary.BigEndian, &f.header); err != nil {
 		return
 	}
@@ -92,7 +78,7 @@ func (f *tcp) decode(upper *ipv4) (err error) {
 	return
 }
 
-func (f *tcp) encode(upper *ipv4) []byte {
+func (f *tcp) encode(upper ipPacket) []byte {
 	f.header.Checksum = 0
 	f.header.Checksum = f.CheckSum(upper)
 	buf := new(bytes.Buffer)
@@ -101,31 +87,58 @@ func (f *tcp) encode(upper *ipv4) []byte {
 	return buf.Bytes()
 }
 
-func (f tcp) handle(upper *ipv4) (err error) {
-	if err = f.decode(upper); err != nil {
-		log.Println(err)
-		return
+// 首部中选项的长度, DataOffset 的高 4 位是首部长度, 单位是 4 字节
+func (f *tcp) optionsLen() int {
+	n := int(f.header.DataOffset>>4)*4 - 20
+	if n < 0 || n > len(f.payload) {
+		return 0
 	}
-	fmt.Printf("%s tcp %s src %d dst %d seq %d\n",
-		green, reset,
-		f.header.SrcPort, f.header.DstPort, f.header.SeqNum)
+	return n
+}
 
-	f.header.SrcPort, f.header.DstPort = f.header.DstPort, f.header.SrcPort
+/*
+	把发往没有监听的端口的报文段改写为 RST (RFC 793 3.4 Reset Generation, CLOSED 状态)
+	- 带有 ACK 时, RST 的序列号取对方的确认号
+	- 否则序列号为 0, 确认对方的整个报文段 (SYN 和 FIN 各占一个序列号)
+*/
+func (f *tcp) reset() {
+	length := uint32(len(f.payload) - f.optionsLen())
 	if f.header.Flags&flagSyn > 0 {
-		f.header.Flags |= flagAck
-		f.header.AckNum = f.header.SeqNum + 1
-		f.header.SeqNum = 0x12345678 // ISN
+		length++
+	}
+	if f.header.Flags&flagFin > 0 {
+		length++
+	}
+	if f.header.Flags&flagAck > 0 {
+		f.header.SeqNum, f.header.AckNum, f.header.Flags = f.header.AckNum, 0, flagRst
+	} else {
+		f.header.SeqNum, f.header.AckNum, f.header.Flags = 0, f.header.SeqNum+length, flagRst|flagAck
 	}
+	f.header.SrcPort, f.header.DstPort = f.header.DstPort, f.header.SrcPort
 	f.header.DataOffset = 5 << 4
+	f.header.WindowSize = 0
+	f.header.UrgentPointer = 0
 	f.payload = nil
+}
 
-	fmt.Printf("%s tcp+%s src %d dst %d seq %d\n",
+func (f tcp) handle(dev *device, upper ipPacket) (err error) {
+	if err = f.decode(upper); err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("%s tcp %s src %d dst %d seq %d\n",
 		green, reset,
 		f.header.SrcPort, f.header.DstPort, f.header.SeqNum)
 
-	upper.header.Src, upper.header.Dst = upper.header.Dst, upper.header.Src
-	upper.header.Len = uint16(upper.header.Version_IHL&0x0f)<<2 + 20
-	upper.payload = f.encode(upper)
-
-	return
+	if err = dev.vrf().tcp.input(dev, upper, &f); err != errNoConnection {
+		return
+	}
+	// 没有连接的报文段按 CLOSED 状态处理
+	if f.header.Flags&flagRst > 0 { // 不能用 RST 回复 RST
+		return errors.New("rst to closed port")
+	}
+	f.reset()
+	upper.swapAddresses()
+	upper.setUpperPayload(f.encode(upper))
+	return nil
 }
@@ -14,6 +14,8 @@ import (
 /*
 	在终端 1 执行  sudo go run . -tags arp
 	在终端 2 执行  sudo arping -I dev1 10.1.0.1
+	在终端 2 执行  sudo arping -D -I dev1 10.1.0.1  发送 ARP probe, 应当收到回复 (Received 1 response(s)), 表示地址已被占用
+	在终端 2 执行  sudo go run -tags ctl . arp -a 查看 ARP 缓存表
 */
 func main(){
 	log.SetFlags(log.Lshortfile)
@@ -28,6 +30,8 @@ func main(){
 	signal.Notify(c, syscall.SIGINT)
 
 	sig := make(chan struct{})
+	go arpCache.age(sig)
+	go serveCtl(sig)
 	go dev.run(sig, func(dev *device, frame *eth) error {
 		switch frame.header.Type {
 		case ethernetTypeARP:
@@ -32,6 +32,8 @@ func main(){
 		switch frame.header.Type {
 		case ethernetTypeIPv4:
 			return (ipv4{}).handle(dev, frame)
+		case ethernetTypeIPv6:
+			return (ipv6{}).handle(dev, frame)
 		}
 		return errors.New("TODO")
 	})
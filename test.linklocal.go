@@ -0,0 +1,44 @@
+// +build linklocal
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+	在终端 1 执行  sudo go run -tags linklocal .
+	设备不配置地址, 协议栈会自动选择一个 169.254.x.x 地址
+	在终端 2 执行  sudo go run -tags ctl . addr 查看选中的地址, 然后 ping 该地址
+*/
+func main(){
+	log.SetFlags(log.Lshortfile)
+	dev,err := tap.open("dev1", linkLocalPrefix.String(), [4]byte{})
+	if err != nil{
+		log.Println(err)
+		return
+	}
+	defer dev.Close()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT)
+
+	sig := make(chan struct{})
+	go arpCache.age(sig)
+	go serveCtl(sig)
+	go dev.run(sig, func(dev *device, frame *eth) error {
+		switch frame.header.Type {
+		case ethernetTypeIPv4:
+			return (ipv4{}).handle(dev, frame)
+		case ethernetTypeARP:
+			return (arp{}).handle(dev, frame)
+		}
+		return errors.New("TODO")
+	})
+	<- c
+	close(sig)
+}
@@ -0,0 +1,53 @@
+// +build router
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+	在终端 1 执行  sudo go run -tags router .
+	协议栈打开 dev1 (10.1.0.1) 和 dev2 (10.2.0.1) 两个设备, 并在它们之间转发
+	在主机上把 dev1, dev2 放进两个 network namespace, 分别配置 10.1.0.2, 10.2.0.2,
+	默认路由指向 10.1.0.1 / 10.2.0.1, 然后互相 ping 或者 traceroute 即可
+	在 10.1 一侧 ping 10.2.0.1 (另一个设备的地址) 也应当收到回复, 协议栈直接在本机接收而不是转发
+*/
+func main(){
+	log.SetFlags(log.Lshortfile)
+	var devs []*device
+	for i := 1; i <= 2; i++ {
+		dev,err := tap.lazy(i)
+		if err != nil{
+			log.Println(err)
+			return
+		}
+		defer dev.Close()
+		devs = append(devs, dev)
+	}
+	setIPv4Forwarding(true)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT)
+
+	sig := make(chan struct{})
+	go arpCache.age(sig)
+	go serveCtl(sig)
+	for _, dev := range devs {
+		go dev.run(sig, func(dev *device, frame *eth) error {
+			switch frame.header.Type {
+			case ethernetTypeIPv4:
+				return (ipv4{}).handle(dev, frame)
+			case ethernetTypeARP:
+				return (arp{}).handle(dev, frame)
+			}
+			return errors.New("TODO")
+		})
+	}
+	<- c
+	close(sig)
+}
@@ -14,6 +14,15 @@ import (
 	在终端 1 执行  sudo go run . -tags tcp
 	在终端 2 执行  nmap -Pn 10.1.0.1 -p 1337
 	结果是 1337/tcp open  waste 即成功
+	执行  nmap -Pn 10.1.0.1 -p 1338  结果是 1338/tcp closed, 没有监听的端口回复 RST
+	执行  nc 10.1.0.1 1337  输入的每一行都会被确认, 按 Ctrl+C 后双方用 FIN 正常关闭连接
+	ipv6 也一样: 用 sudo go run -tags ctl . addr add dev1 fd00:1::1/64 添加地址, 主机上执行 sudo ip addr add fd00:1::2/64 dev dev1 后
+	执行  nmap -6 -Pn fd00:1::1 -p 1337  结果同样是 open
+	icmp 硬错误中止连接: 先在主机上执行
+		sudo iptables -I INPUT -p tcp --sport 1337 -j REJECT --reject-with icmp-port-unreachable
+	再执行  nc 10.1.0.1 1337  主机用端口不可达回复我们的 SYN+ACK,
+	终端 1 输出 tcp port 1337 closed: <主机地址>:<端口>: connection refused 即成功
+	最后用  sudo iptables -D INPUT -p tcp --sport 1337 -j REJECT --reject-with icmp-port-unreachable  删除规则
 */
 func main(){
 	log.SetFlags(log.Lshortfile)
@@ -23,15 +32,23 @@ func main(){
 		return
 	}
 	defer dev.Close()
+	if err = HostTCP.listen(1337); err != nil {
+		log.Println(err)
+		return
+	}
 
 	c := make(chan os.Signal)
 	signal.Notify(c, syscall.SIGINT)
 
 	sig := make(chan struct{})
+	go arpCache.age(sig)
+	go serveCtl(sig)
 	go dev.run(sig, func(dev *device, frame *eth) error {
 		switch frame.header.Type {
 		case ethernetTypeIPv4:
 			return (ipv4{}).handle(dev, frame)
+		case ethernetTypeIPv6:
+			return (ipv6{}).handle(dev, frame)
 		case ethernetTypeARP:
 			return (arp{}).handle(dev, frame)
 		}
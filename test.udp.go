@@ -0,0 +1,71 @@
+// +build udp
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+	在终端 1 执行  sudo go run -tags udp .
+	协议栈在 dev1 (10.1.0.1) 的 5000 端口上运行 udp echo, 并加入组播组 239.1.1.1
+	在终端 2 执行  nc -u 10.1.0.1 5000  测试单播
+	组播可以在主机上添加路由  ip route add 239.1.1.1 dev dev1  后用 socat 发往 239.1.1.1:5000
+*/
+func main(){
+	log.SetFlags(log.Lshortfile)
+	dev,err := tap.lazy(1)
+	if err != nil{
+		log.Println(err)
+		return
+	}
+	defer dev.Close()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT)
+
+	sock, err := HostUDP.bind([4]byte{}, 5000)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer sock.close()
+	if err = sock.joinGroup(dev, [4]byte{239, 1, 1, 1}); err != nil {
+		log.Println(err)
+		return
+	}
+	go func() {
+		for {
+			datagram, err := sock.recv()
+			if err == errSocketClosed {
+				return
+			}
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if err := sock.sendTo(datagram.src, datagram.srcPort, datagram.payload); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	sig := make(chan struct{})
+	go arpCache.age(sig)
+	go serveCtl(sig)
+	go dev.run(sig, func(dev *device, frame *eth) error {
+		switch frame.header.Type {
+		case ethernetTypeIPv4:
+			return (ipv4{}).handle(dev, frame)
+		case ethernetTypeARP:
+			return (arp{}).handle(dev, frame)
+		}
+		return errors.New("TODO")
+	})
+	<- c
+	close(sig)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+/*
+
+0               1               2               3               4
+0 1 2 3 4 5 6 7 8 1 2 3 4 5 6 7 8 1 2 3 4 5 6 7 8 1 2 3 4 5 6 7 8
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|          Source Port          |       Destination Port        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|            Length             |           Checksum            |  Length 包括首部和数据, Checksum 为 0 表示不校验
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                             data                              |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+*/
+
+type udp struct {
+	header struct {
+		SrcPort  uint16
+		DstPort  uint16
+		Len      uint16
+		Checksum uint16
+	}
+	payload []byte
+}
+
+// 与 tcp 一样, 校验和包括由 ip 首部得到的伪首部
+func (f *udp) CheckSum(upper ipPacket) uint16 {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &f.header)
+	binary.Write(buf, binary.BigEndian, f.payload)
+	return transportCheckSum(upper, uint8(ipv4ProtocolTypeUDP), buf.Bytes())
+}
+
+func (f *udp) decode(upper ipPacket) (err error) {
+	data := upper.upperPayload()
+	var buf = bytes.NewBuffer(data)
+	if err = binary.Read(buf, binary.BigEndian, &f.header); err != nil {
+		return
+	}
+	if int(f.header.Len) < 8 || int(f.header.Len) > len(data) {
+		return fmt.Errorf("udp length error (%d)", f.header.Len)
+	}
+	f.payload = data[8:f.header.Len]
+	if f.header.Checksum != 0 {
+		if sum := f.CheckSum(upper); sum != 0 {
+			return fmt.Errorf("udp checksum error (%x)", sum)
+		}
+	}
+	return
+}
+
+func (f *udp) encode(upper ipPacket) []byte {
+	f.header.Len = uint16(8 + len(f.payload))
+	f.header.Checksum = 0
+	if f.header.Checksum = f.CheckSum(upper); f.header.Checksum == 0 {
+		f.header.Checksum = 0xffff // 计算结果为 0 时发送全 1, 因为 0 表示不校验
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &f.header)
+	binary.Write(buf, binary.BigEndian, f.payload)
+	return buf.Bytes()
+}
+
+func (f udp) handle(dev *device, upper *ipv4) (err error) {
+	if err = f.decode(upper); err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("%s udp %s src %d dst %d len %d\n",
+		cyan, reset,
+		f.header.SrcPort, f.header.DstPort, len(f.payload))
+
+	if dev.vrf().udp.deliver(dev, upper, &f) == 0 {
+		// 发往广播和组播地址的数据报没有接收者是正常的, 不回复
+		if !dev.isIPv4Broadcast(upper.header.Dst) && !ipv4IsMulticast(upper.header.Dst) {
+			dev.sendIcmpError(upper, icmpTypeDestUnreachable, icmpCodePortUnreachable, 0)
+		}
+		return errors.New("no udp socket")
+	}
+	return errors.New("do nothing") // 由 socket 决定是否回复
+}
+
+/*
+	ipv6 的 udp 校验和是必须的, 为 0 时丢弃 (RFC 8200 8.1)
+	udpHost 的 socket 只能绑定 ipv4 地址, 没有接收 ipv6 数据报的 socket,
+	所以发往单播地址的数据报都回复端口不可达, 与没有监听该端口时相同
+*/
+func (f udp) handleIPv6(dev *device, upper *ipv6) (err error) {
+	if err = f.decode(upper); err != nil {
+		log.Println(err)
+		return
+	}
+	if f.header.Checksum == 0 {
+		return errors.New("udp over ipv6 without checksum")
+	}
+	fmt.Printf("%s udp6 %s src %d dst %d len %d\n",
+		cyan, reset,
+		f.header.SrcPort, f.header.DstPort, len(f.payload))
+
+	if !ipv6IsMulticast(upper.header.Dst) {
+		dev.sendIcmpv6Error(upper, icmpv6TypeDestUnreachable, icmpv6CodePortUnreachable, 0)
+	}
+	return errors.New("no udp socket for ipv6")
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	udpSocketQueueSize = 64
+	udpEphemeralMin    = 49152
+)
+
+var errSocketClosed = errors.New("use of closed socket")
+
+type udpDatagram struct {
+	dev              *device // 收到该数据报的设备
+	src, dst         [4]byte
+	srcPort, dstPort uint16
+	payload          []byte
+}
+
+type udpMembership struct {
+	dev   *device
+	group [4]byte
+}
+
+type udpSocket struct {
+	host         *udpHost
+	addr         [4]byte // 绑定的本地地址, 0.0.0.0 表示任意地址
+	port         uint16
+	peer         [4]byte // connect 设置的对端地址和端口, peerPort 为 0 表示没有连接, 由 host.mutex 保护
+	peerPort     uint16
+	inputCh      chan *udpDatagram
+	memberships  []udpMembership
+	multicastDev *device // 发送组播时使用的设备, 默认是最近一次加入组播组的设备
+	multicastTTL uint8
+	mark         uint32        // 发出的数据报的 fwmark, 用于策略路由
+	err          *icmpError    // 最近收到的 icmp 差错, 只有连接的 socket 才会收到, 下一次接收或者发送时返回
+	errCh        chan struct{} // 收到 icmp 差错时通知阻塞在 recv 中的调用者
+	closed       bool
+	mutex        sync.Mutex
+}
+
+type udpHost struct {
+	sockets []*udpSocket
+	vrf     *vrf // 端口空间所属的 VRF, nil 表示 defaultVRF
+	mutex   sync.RWMutex
+}
+
+var HostUDP = udpHost{}
+
+func (host *udpHost) domain() *vrf {
+	if host.vrf == nil {
+		return defaultVRF
+	}
+	return host.vrf
+}
+
+// 绑定本地地址和端口, port 为 0 时分配一个临时端口
+func (host *udpHost) bind(addr [4]byte, port uint16) (*udpSocket, error) {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+	if port == 0 {
+		for p := udpEphemeralMin; p <= 0xffff && port == 0; p++ {
+			if !host.inUseUnlocked(addr, uint16(p)) {
+				port = uint16(p)
+			}
+		}
+		if port == 0 {
+			return nil, errors.New("no free udp port")
+		}
+	} else if host.inUseUnlocked(addr, port) {
+		return nil, errors.New("address already in use")
+	}
+	s := &udpSocket{
+		host:         host,
+		addr:         addr,
+		port:         port,
+		inputCh:      make(chan *udpDatagram, udpSocketQueueSize),
+		errCh:        make(chan struct{}, 1),
+		multicastTTL: 1,
+	}
+	host.sockets = append(host.sockets, s)
+	return s, nil
+}
+
+func (host *udpHost) inUseUnlocked(addr [4]byte, port uint16) bool {
+	for _, s := range host.sockets {
+		if s.port == port && (s.addr == addr || s.addr == [4]byte{} || addr == [4]byte{}) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	把数据报交给 socket, 返回接收的 socket 数
+	单播只交给一个 socket, 绑定了具体地址的优先于绑定 0.0.0.0 的
+	广播交给所有绑定该端口的 socket, 组播只交给在收包设备上加入了该组的 socket
+*/
+func (host *udpHost) deliver(dev *device, upper *ipv4, f *udp) int {
+	dst := upper.header.Dst
+	multicast := ipv4IsMulticast(dst)
+	broadcast := dev.isIPv4Broadcast(dst)
+	host.mutex.RLock()
+	var matched []*udpSocket
+	var exact, wildcard *udpSocket
+	for _, s := range host.sockets {
+		if s.port != f.header.DstPort {
+			continue
+		}
+		if s.peerPort != 0 && (s.peer != upper.header.Src || s.peerPort != f.header.SrcPort) {
+			continue // 连接的 socket 只接收对端发来的数据报
+		}
+		switch {
+		case multicast:
+			if (s.addr == [4]byte{} || s.addr == dst) && s.isMember(dev, dst) {
+				matched = append(matched, s)
+			}
+		case broadcast:
+			matched = append(matched, s)
+		case s.addr == dst:
+			exact = s
+		case s.addr == [4]byte{}:
+			wildcard = s
+		}
+	}
+	host.mutex.RUnlock()
+	if exact != nil {
+		matched = append(matched, exact)
+	} else if wildcard != nil {
+		matched = append(matched, wildcard)
+	}
+
+	for _, s := range matched {
+		s.input(&udpDatagram{
+			dev:     dev,
+			src:     upper.header.Src,
+			dst:     dst,
+			srcPort: f.header.SrcPort,
+			dstPort: f.header.DstPort,
+			payload: append([]byte(nil), f.payload...), // 收包的缓冲区会被复用
+		})
+	}
+	return len(matched)
+}
+
+/*
+	把 icmp 差错交给发出原数据报的 socket, 选择 socket 的规则与单播接收相同
+	udp 必须把差错报告给应用 (RFC 1122 4.1.3.3), 差错记在 socket 上, 下一次接收或者发送时返回并清除
+	与 Linux (没有设置 IP_RECVERR 时) 相同, 只报告给对端是原数据报目的地址和端口的连接的 socket,
+	没有连接的 socket 无法确认差错对应自己发出的哪个数据报, 伪造的差错也会干扰它的接收
+*/
+func (host *udpHost) notify(addr [4]byte, port uint16, e *icmpError) bool {
+	host.mutex.RLock()
+	var exact, wildcard *udpSocket
+	for _, s := range host.sockets {
+		if s.port != port || s.peerPort == 0 || s.peer != e.dst || s.peerPort != e.dstPort {
+			continue
+		}
+		switch {
+		case s.addr == addr:
+			exact = s
+		case s.addr == [4]byte{}:
+			wildcard = s
+		}
+	}
+	host.mutex.RUnlock()
+	if exact == nil {
+		exact = wildcard
+	}
+	if exact == nil {
+		return false
+	}
+	exact.mutex.Lock()
+	exact.err = e
+	exact.mutex.Unlock()
+	select {
+	case exact.errCh <- struct{}{}:
+	default: // 已经有一个通知没有处理
+	}
+	return true
+}
+
+func (s *udpSocket) input(datagram *udpDatagram) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.inputCh <- datagram:
+	default: // 接收队列满了, 丢弃
+	}
+}
+
+// 取出并清除待报告的 icmp 差错
+func (s *udpSocket) takeErr() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e := s.err; e != nil {
+		s.err = nil
+		return e
+	}
+	return nil
+}
+
+/*
+	接收一个数据报, 有待报告的 icmp 差错时先返回差错 (RFC 1122 4.1.3.3)
+	socket 关闭后返回 errSocketClosed
+*/
+func (s *udpSocket) recv() (*udpDatagram, error) {
+	for {
+		if err := s.takeErr(); err != nil {
+			return nil, err
+		}
+		select {
+		case datagram, ok := <-s.inputCh:
+			if !ok {
+				return nil, errSocketClosed
+			}
+			return datagram, nil
+		case <-s.errCh: // 差错可能已经被 sendTo 取走, 回到循环开头检查
+		}
+	}
+}
+
+// 设置对端, 之后只接收对端发来的数据报, 并接收发往对端的数据报引起的 icmp 差错
+func (s *udpSocket) connect(addr [4]byte, port uint16) error {
+	if port == 0 {
+		return errors.New("invalid port")
+	}
+	s.host.mutex.Lock()
+	defer s.host.mutex.Unlock()
+	s.peer, s.peerPort = addr, port
+	return nil
+}
+
+func (s *udpSocket) sendTo(dst [4]byte, port uint16, payload []byte) error {
+	var ip ipv4
+	ip.header.Protocol = ipv4ProtocolTypeUDP
+	ip.header.Src = s.addr
+	ip.header.Dst = dst
+	s.mutex.Lock()
+	ip.mark = s.mark
+	if e := s.err; e != nil && e.dst == dst && e.dstPort == port {
+		s.err = nil
+		s.mutex.Unlock()
+		return e
+	}
+	s.mutex.Unlock()
+	var dev *device
+	if ipv4IsMulticast(dst) {
+		s.mutex.Lock()
+		dev, ip.header.TTL = s.multicastDev, s.multicastTTL
+		s.mutex.Unlock()
+		if dev == nil {
+			return errors.New("no multicast interface")
+		}
+		if ip.header.Src == [4]byte{} {
+			ip.header.Src = dev.selectSourceIPv4(dst)
+		}
+	} else if ip.header.Src == [4]byte{} {
+		// 校验和需要源地址, 所以要先选好源地址
+		if ip.header.Src = s.host.domain().selectSourceIPv4(dst, ip.mark); ip.header.Src == [4]byte{} {
+			return errors.New("no route to host")
+		}
+	}
+	datagram := udp{payload: payload}
+	datagram.header.SrcPort = s.port
+	datagram.header.DstPort = port
+	ip.payload = datagram.encode(&ip)
+	if dev != nil {
+		return dev.sendIPv4Multicast(&ip)
+	}
+	return s.host.domain().sendIPv4(&ip)
+}
+
+func (s *udpSocket) isMember(dev *device, group [4]byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, m := range s.memberships {
+		if m.dev == dev && m.group == group {
+			return true
+		}
+	}
+	return false
+}
+
+// 在设备上加入组播组
+func (s *udpSocket) joinGroup(dev *device, group [4]byte) error {
+	if !ipv4IsMulticast(group) {
+		return errors.New("not a multicast address")
+	}
+	if s.isMember(dev, group) {
+		return errors.New("already a member")
+	}
+	if dev.vrf() != s.host.domain() {
+		return errors.New("device is not in the socket's vrf")
+	}
+	if err := dev.joinIPv4Group(group); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.memberships = append(s.memberships, udpMembership{dev: dev, group: group})
+	s.multicastDev = dev
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *udpSocket) leaveGroup(dev *device, group [4]byte) error {
+	s.mutex.Lock()
+	found := false
+	for i, m := range s.memberships {
+		if m.dev == dev && m.group == group {
+			s.memberships = append(s.memberships[:i], s.memberships[i+1:]...)
+			found = true
+			break
+		}
+	}
+	s.mutex.Unlock()
+	if !found {
+		return errors.New("not a member")
+	}
+	return dev.leaveIPv4Group(group)
+}
+
+// 设置发出数据报的 fwmark, 相当于 SO_MARK
+func (s *udpSocket) setMark(mark uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mark = mark
+}
+
+func (s *udpSocket) close() {
+	host := s.host
+	host.mutex.Lock()
+	for i, socket := range host.sockets {
+		if socket == s {
+			host.sockets = append(host.sockets[:i], host.sockets[i+1:]...)
+			break
+		}
+	}
+	host.mutex.Unlock()
+
+	s.mutex.Lock()
+	memberships := s.memberships
+	s.memberships = nil
+	if !s.closed {
+		s.closed = true
+		close(s.inputCh)
+	}
+	s.mutex.Unlock()
+	for _, m := range memberships {
+		m.dev.leaveIPv4Group(m.group)
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"net"
+)
+
 func CheckSum16(b []byte, n int, init uint32) uint16 {
 	/*
 		发送数据时
@@ -28,3 +33,30 @@ func CheckSum16(b []byte, n int, init uint32) uint16 {
 	}
 	return ^(uint16(sum)) // 取反. 使用反码可以保证 无论是 大端还是小端， 计算的结果都是一致的
 }
+
+func parseIPv4(s string) (addr [4]byte, err error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return addr, fmt.Errorf("invalid ipv4 address %q", s)
+	}
+	copy(addr[:], ip)
+	return addr, nil
+}
+
+func parseMAC(s string) (addr [6]byte, err error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return addr, fmt.Errorf("invalid mac address %q", s)
+	}
+	copy(addr[:], mac)
+	return addr, nil
+}
+
+func parseIPv6(s string) (addr [16]byte, err error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return addr, fmt.Errorf("invalid ipv6 address %q", s)
+	}
+	copy(addr[:], ip.To16())
+	return addr, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+/*
+	VRF (virtual routing and forwarding), 把设备分到互相隔离的路由域中
+	每个 VRF 有自己的策略路由规则和路由表, ARP 缓存, proxy ARP 网段, 源地址过滤设置以及 tcp/udp 的端口空间,
+	所以不同 VRF 中可以出现重叠的网段 (比如多个 tuntap.lazy 生成的 10.x.0.0/24)
+	数据报只会在同一个 VRF 的设备之间转发, 没有加入任何 VRF 的设备属于 defaultVRF
+*/
+type vrf struct {
+	name     string
+	rules    *ipv4RuleList
+	routes6  *ipv6RouteTable
+	arp      *arpTable
+	pending  *arpResolver
+	ndp      *ndpTable
+	pending6 *ndpResolver
+	proxyArp *proxyArpTable
+	filter   *ipv4SourceFilter
+	udp      *udpHost
+	tcp      *tcpHost
+	aging    sync.Once
+}
+
+var defaultVRF = &vrf{
+	name:     "default",
+	rules:    ipv4Rules,
+	routes6:  ipv6Routes,
+	arp:      arpCache,
+	pending:  arpPendingQueue,
+	ndp:      ndpCache,
+	pending6: ndpPendingQueue,
+	proxyArp: &proxyArpTable{},
+	filter:   &ipv4SourceFilter{},
+	udp:      &HostUDP,
+	tcp:      &HostTCP,
+}
+
+var (
+	vrfs      = []*vrf{defaultVRF}
+	vrfsMutex sync.RWMutex
+)
+
+func newVRF(name string) (*vrf, error) {
+	vrfsMutex.Lock()
+	defer vrfsMutex.Unlock()
+	for _, v := range vrfs {
+		if v.name == name {
+			return nil, errors.New("vrf already exists")
+		}
+	}
+	v := &vrf{
+		name:     name,
+		rules:    newIPv4RuleList(newIPv4RouteTable()),
+		routes6:  newIPv6RouteTable(),
+		arp:      newArpTable(),
+		ndp:      newNdpTable(),
+		proxyArp: &proxyArpTable{},
+		filter:   &ipv4SourceFilter{},
+	}
+	v.pending = newArpResolver(v.arp)
+	v.pending6 = newNdpResolver(v.ndp)
+	v.udp = &udpHost{vrf: v}
+	v.tcp = &tcpHost{vrf: v}
+	vrfs = append(vrfs, v)
+	return v, nil
+}
+
+func vrfByName(name string) *vrf {
+	vrfsMutex.RLock()
+	defer vrfsMutex.RUnlock()
+	for _, v := range vrfs {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func vrfList() []*vrf {
+	vrfsMutex.RLock()
+	defer vrfsMutex.RUnlock()
+	return append([]*vrf(nil), vrfs...)
+}
+
+// 删除 VRF, 还有设备属于它时不能删除
+func removeVRF(name string) error {
+	if name == defaultVRF.name {
+		return errors.New("cannot remove the default vrf")
+	}
+	v := vrfByName(name)
+	if v == nil {
+		return errors.New("no such vrf")
+	}
+	if len(v.devices()) > 0 {
+		return errors.New("vrf still has devices")
+	}
+	vrfsMutex.Lock()
+	defer vrfsMutex.Unlock()
+	for i, w := range vrfs {
+		if w == v {
+			vrfs = append(vrfs[:i], vrfs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// 属于该 VRF 的设备
+func (v *vrf) devices() []*device {
+	var list []*device
+	for _, dev := range devices {
+		if dev.vrf() == v {
+			list = append(list, dev)
+		}
+	}
+	return list
+}
+
+/*
+	addr 是否是该 VRF 中任意一个设备的可用地址
+	本地接收采用弱主机模型 (RFC 1122 3.3.4.2), 发给本机其它设备地址的数据报也在本机接收, 不转发
+*/
+func (v *vrf) ownsIPv4(addr [4]byte) bool {
+	for _, dev := range v.devices() {
+		if dev.ownsIPv4(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	VRF 的第一个设备运行时, 邻居缓存开始老化
+	defaultVRF 的 arpCache 由 main 负责老化, 这里只处理它的 ndpCache
+*/
+func (v *vrf) startAging(sig chan struct{}) {
+	if sig == nil {
+		return
+	}
+	v.aging.Do(func() {
+		go v.ndp.age(sig)
+		if v != defaultVRF {
+			go v.arp.age(sig)
+		}
+	})
+}
+
+func (dev *device) vrf() *vrf {
+	dev.mutex.RLock()
+	defer dev.mutex.RUnlock()
+	if dev.master == nil {
+		return defaultVRF
+	}
+	return dev.master
+}
+
+/*
+	把设备移到另一个 VRF
+	设备的直连路由随之移动, 旧 VRF 中经过该设备的其它路由和 proxy ARP 网段被删除, ARP 缓存和挂起的数据报不迁移
+*/
+func (dev *device) setVRF(v *vrf) {
+	old := dev.vrf()
+	if old == v {
+		return
+	}
+	dev.mutex.Lock()
+	dev.master = v
+	sig := dev.sig
+	dev.mutex.Unlock()
+	old.rules.removeDevice(dev)
+	old.routes6.removeDevice(dev)
+	old.proxyArp.removeDevice(dev)
+	for _, a := range dev.ipv4Addresses() {
+		v.rules.table(ipv4TableMain, true).add(&ipv4Route{prefix: a.prefix, dev: dev, connected: true})
+	}
+	for _, a := range dev.ipv6Addresses() {
+		v.routes6.add(&ipv6Route{prefix: a.prefix, dev: dev, connected: true})
+	}
+	v.startAging(sig)
+}